@@ -0,0 +1,73 @@
+package volumeplugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotSupported is returned by a Backend for operations it does not
+// implement. Callers fall back to the default behavior where one exists.
+var ErrNotSupported = errors.New("Unsupported Operation")
+
+// Backend is the contract between RancherStorageDriver and a storage driver.
+// Drivers can be written in Go and plugged in directly, or be an external
+// script driven through ScriptBackend.
+type Backend interface {
+	// Init is called once when the plugin starts.
+	Init() error
+	// Create provisions the volume and returns options that should be
+	// persisted along with it.
+	Create(name string, options map[string]string) (map[string]string, error)
+	// Delete destroys the volume described by options.
+	Delete(name string, options map[string]string) error
+	// Attach makes the volume available on this host and returns the
+	// device, if any, to pass to Mount.
+	Attach(name string, options map[string]string) (string, error)
+	// Detach releases a device returned by Attach.
+	Detach(device string) error
+	// Mount mounts the volume, optionally from device, on mntDest.
+	Mount(mntDest, device, name string, options map[string]string) error
+	// Unmount unmounts mntDest.
+	Unmount(mntDest string) error
+}
+
+// DriverError is a failure reported by a Backend for a given operation.
+// Stderr is the end of what the driver logged, if anything.
+type DriverError struct {
+	Op      string
+	Message string
+	Stderr  string
+}
+
+func (e *DriverError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = fmt.Sprintf("%s failed", e.Op)
+	}
+	if e.Stderr != "" {
+		return fmt.Sprintf("%s, stderr: %s", message, e.Stderr)
+	}
+	return message
+}
+
+// TimeoutError is returned when a backend operation did not finish in time
+// and was killed. The operation may have been done partially, all operations
+// of the drivers are safe to retry.
+type TimeoutError struct {
+	Op      string
+	Timeout time.Duration
+}
+
+const timeoutMessage = "Timed out after"
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %v running %s", timeoutMessage, e.Timeout, e.Op)
+}
+
+// IsTimeout returns true if err, as returned in a volume.Response, was caused
+// by a backend operation timing out.
+func IsTimeout(err string) bool {
+	return strings.Contains(err, timeoutMessage)
+}
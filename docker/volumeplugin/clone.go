@@ -0,0 +1,65 @@
+package volumeplugin
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// cloneFromOption is the create option naming the volume to copy
+const cloneFromOption = "cloneFrom"
+
+// Cloner is implemented by backends that can create a volume as a copy of an
+// existing one.
+type Cloner interface {
+	Clone(name string, options map[string]string, source string, sourceOptions map[string]string) (map[string]string, error)
+}
+
+func (d *RancherStorageDriver) clone(name string, options map[string]string, source string) (map[string]string, error) {
+	c, ok := d.Backend.(Cloner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	if source == name {
+		return nil, errors.Errorf("Volume %s can not be cloned from itself", name)
+	}
+	// the source is neither mounted nor removed while it is copied, the
+	// caller holds the slot of the clone
+	defer d.locks.lockName(source)()
+
+	_, rVol, err := d.state.Get(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding volume %s to clone", source)
+	}
+	// a copy of a volume being written to is not consistent
+	if mounted, err := d.isMountedReadWrite(d.getMntDest(source)); err != nil {
+		return nil, err
+	} else if mounted {
+		return nil, errors.Errorf("Volume %s is mounted read-write, unmount it to clone it", source)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"name":   name,
+		"source": source,
+	}).Info("clone.request")
+
+	sourceOptions := getOptions(rVol)
+	cloneOptions := map[string]string{}
+	for k, v := range options {
+		if k != cloneFromOption {
+			cloneOptions[k] = v
+		}
+	}
+	// the copy has the filesystem of its source, if one was requested
+	requested := map[string]string{}
+	if fs := d.getFsType(sourceOptions); fs != "" {
+		requested[fsType] = fs
+	}
+	cloneOptions = Fold(cloneOptions, requested)
+
+	result, err := c.Clone(name, cloneOptions, source, sourceOptions)
+	if err != nil {
+		return nil, err
+	}
+	return Fold(requested, result), nil
+}
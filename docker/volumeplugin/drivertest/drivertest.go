@@ -0,0 +1,428 @@
+// Package drivertest runs the lifecycle the plugin drives a volume through
+// against a driver script and checks that every call follows the contract in
+// package/common/common.sh.
+package drivertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/storage/docker/volumeplugin"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	statusSuccess      = "Success"
+	statusFailure      = "Failure"
+	statusNotSupported = "Not supported"
+)
+
+// Result is the outcome of one step of the lifecycle. Skipped steps are not
+// supported by the driver or depend on a step that failed.
+type Result struct {
+	Step    string
+	Skipped string
+	Err     error
+}
+
+// Harness creates a volume with Options, attaches it, mounts it under Dir,
+// then tears everything down again.
+type Harness struct {
+	Command string
+	Options map[string]string
+	Name    string
+	Dir     string
+	mounter mount.Interface
+
+	results []Result
+	options map[string]string
+	device  string
+	mntDest string
+	loops   map[string]string
+}
+
+func NewHarness(command string, options map[string]string) *Harness {
+	return &Harness{
+		Command: command,
+		Options: options,
+		Name:    fmt.Sprintf("driver-test-%d", time.Now().Unix()),
+		mounter: mount.New(),
+	}
+}
+
+// Run runs the whole lifecycle and returns the result of every step
+func (h *Harness) Run() ([]Result, error) {
+	if h.Dir == "" {
+		dir, err := ioutil.TempDir("", "driver-test")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		h.Dir = dir
+	}
+	h.mntDest = filepath.Join(h.Dir, h.Name)
+	if err := os.MkdirAll(h.mntDest, 0750); err != nil {
+		return nil, err
+	}
+
+	loops, err := loopDevices()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing loop devices")
+	}
+	h.loops = loops
+
+	h.results = nil
+	h.step("init", "", h.init)
+	created := h.step("create", "", h.create)
+	h.step("idempotent create", dependsOn(created, "create"), h.createAgain)
+	h.step("list", dependsOn(created, "create"), h.list)
+	attached := h.step("attach", dependsOn(created, "create"), h.attach)
+	mounted := h.step("mount", dependsOn(attached, "attach"), h.mount)
+	h.step("double mount", dependsOn(mounted, "mount"), h.mountAgain)
+	h.step("unmount", dependsOn(mounted, "mount"), h.unmount)
+	h.step("detach", h.skipDetach(attached), h.detach)
+	deleted := h.step("delete", dependsOn(created, "create"), h.delete)
+	h.step("delete missing", dependsOn(deleted, "delete"), h.delete)
+	h.step("leaks", "", h.checkLeaks)
+	return h.results, nil
+}
+
+func dependsOn(ok bool, step string) string {
+	if ok {
+		return ""
+	}
+	return step + " did not succeed"
+}
+
+func (h *Harness) skipDetach(attached bool) string {
+	if !attached {
+		return dependsOn(false, "attach")
+	}
+	if h.device == "" {
+		return "attach returned no device"
+	}
+	return ""
+}
+
+// step records the result of call and reports whether it succeeded
+func (h *Harness) step(name, skip string, call func() error) bool {
+	result := Result{Step: name, Skipped: skip}
+	if skip == "" {
+		result.Err = call()
+		if result.Err == volumeplugin.ErrNotSupported {
+			result.Err = nil
+			result.Skipped = "not supported"
+		}
+	}
+	h.results = append(h.results, result)
+	return result.Skipped == "" && result.Err == nil
+}
+
+func (h *Harness) init() error {
+	_, err := h.exec("init")
+	return err
+}
+
+func (h *Harness) create() error {
+	output, err := h.exec("create", h.args(h.Options))
+	if err != nil {
+		return err
+	}
+	h.options = volumeplugin.Fold(h.Options, output.Options)
+	return nil
+}
+
+// createAgain creates the same volume again, the plugin retries a create
+// that timed out or failed to be saved and must get the same volume back.
+func (h *Harness) createAgain() error {
+	output, err := h.exec("create", h.args(h.Options))
+	if err != nil {
+		return err
+	}
+	options := volumeplugin.Fold(h.Options, output.Options)
+	if !reflect.DeepEqual(options, h.options) {
+		h.exec("delete", h.args(options))
+		return fmt.Errorf("create is not idempotent, the second create returned %v instead of %v", output.Options, h.options)
+	}
+	return nil
+}
+
+// list must return the created volume, by name or by volumeID for drivers
+// that do not know the names of their volumes
+func (h *Harness) list() error {
+	output, err := h.exec("list", h.args(h.Options))
+	if err != nil {
+		return err
+	}
+	for _, vol := range output.Volumes {
+		if vol.Name == h.Name {
+			return nil
+		}
+		if vol.Name == "" && vol.Options["volumeID"] != "" && vol.Options["volumeID"] == h.options["volumeID"] {
+			return nil
+		}
+	}
+	return fmt.Errorf("list did not return %s in %d volumes", h.Name, len(output.Volumes))
+}
+
+func (h *Harness) attach() error {
+	output, err := h.exec("attach", h.args(h.options))
+	if err != nil {
+		return err
+	}
+	h.device = output.Device
+	if h.device == "" {
+		return nil
+	}
+	if _, err := os.Stat(h.device); err != nil {
+		return errors.Wrapf(err, "attach returned device %s", h.device)
+	}
+
+	output, err = h.exec("attach", h.args(h.options))
+	if err != nil {
+		return errors.Wrap(err, "attaching again")
+	}
+	if output.Device != h.device {
+		return fmt.Errorf("attach is not idempotent, attaching again returned %s instead of %s", output.Device, h.device)
+	}
+	return nil
+}
+
+func (h *Harness) mount() error {
+	if _, err := h.exec("mount", h.mntDest, h.device, h.args(h.options)); err != nil {
+		return err
+	}
+	if count, err := h.mountCount(); err != nil {
+		return err
+	} else if count == 0 {
+		return fmt.Errorf("mount succeeded but %s is not a mount point", h.mntDest)
+	}
+	return nil
+}
+
+// mountAgain mounts on the same directory again, the plugin does that when
+// its mount records were lost. Stacked mounts are removed so the following
+// steps start from a single mount.
+func (h *Harness) mountAgain() error {
+	if _, err := h.exec("mount", h.mntDest, h.device, h.args(h.options)); err != nil {
+		return err
+	}
+	count, err := h.mountCount()
+	if err != nil {
+		return err
+	}
+	for i := count; i > 1; i-- {
+		h.mounter.Unmount(h.mntDest)
+	}
+	if count > 1 {
+		return fmt.Errorf("mount is not idempotent, %s was mounted %d times", h.mntDest, count)
+	}
+	return nil
+}
+
+func (h *Harness) unmount() error {
+	if _, err := h.exec("unmount", h.mntDest, h.args(h.options)); err == volumeplugin.ErrNotSupported {
+		// The plugin unmounts itself
+		if err := h.mounter.Unmount(h.mntDest); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if count, err := h.mountCount(); err != nil {
+		return err
+	} else if count > 0 {
+		return fmt.Errorf("unmount succeeded but %s is still mounted", h.mntDest)
+	}
+	return nil
+}
+
+func (h *Harness) detach() error {
+	if _, err := h.exec("detach", h.device); err != nil {
+		return err
+	}
+	loops, err := loopDevices()
+	if err != nil {
+		return err
+	}
+	if file, ok := loops[h.device]; ok {
+		return fmt.Errorf("detach succeeded but %s is still attached to %s", h.device, file)
+	}
+	return nil
+}
+
+// delete is called twice, deleting a volume that is already gone must succeed
+// as the plugin retries removals that failed half way.
+func (h *Harness) delete() error {
+	_, err := h.exec("delete", h.args(h.options))
+	return err
+}
+
+func (h *Harness) checkLeaks() error {
+	var leaks []string
+
+	loops, err := loopDevices()
+	if err != nil {
+		return err
+	}
+	for device, file := range loops {
+		if _, ok := h.loops[device]; !ok {
+			leaks = append(leaks, fmt.Sprintf("loop device %s of %s", device, file))
+		}
+	}
+
+	mounts, err := h.mounter.List()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if strings.HasPrefix(m.Path, h.Dir) {
+			leaks = append(leaks, fmt.Sprintf("mount of %s on %s", m.Device, m.Path))
+		}
+	}
+
+	if len(leaks) > 0 {
+		return fmt.Errorf("leaked %s", strings.Join(leaks, ", "))
+	}
+	return nil
+}
+
+func (h *Harness) mountCount() (int, error) {
+	mounts, err := h.mounter.List()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, m := range mounts {
+		if m.Path == h.mntDest {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (h *Harness) args(options map[string]string) string {
+	bytes, err := json.Marshal(volumeplugin.Fold(options, map[string]string{
+		"name":    h.Name,
+		"rancher": "true",
+	}))
+	if err != nil {
+		panic(err)
+	}
+	return string(bytes)
+}
+
+// exec runs the driver like ScriptBackend does, but fails on any output the
+// plugin would only accept by accident.
+func (h *Harness) exec(command string, args ...string) (volumeplugin.CmdOutput, error) {
+	var result volumeplugin.CmdOutput
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(h.Command, append([]string{command}, args...)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	runErr := cmd.Run()
+	if _, ok := runErr.(*exec.ExitError); runErr != nil && !ok {
+		return result, runErr
+	}
+
+	if err := decode(stdout.Bytes(), &result); err != nil {
+		return result, errors.Wrapf(err, "invalid output of %s %q, stderr: %s", command, stdout.String(), tail(stderr.String()))
+	}
+
+	switch result.Status {
+	case statusSuccess, statusNotSupported:
+		if runErr != nil {
+			return result, fmt.Errorf("%s reported %s but exited with %v", command, result.Status, runErr)
+		}
+	case statusFailure:
+		if runErr == nil {
+			return result, fmt.Errorf("%s reported %s but exited with 0, use print_error", command, result.Status)
+		}
+		if result.Message == "" {
+			return result, fmt.Errorf("%s reported %s without a message", command, result.Status)
+		}
+		return result, &volumeplugin.DriverError{Op: command, Message: result.Message}
+	default:
+		return result, fmt.Errorf("%s reported unknown status %q", command, result.Status)
+	}
+
+	if result.Status == statusNotSupported {
+		return result, volumeplugin.ErrNotSupported
+	}
+	return result, nil
+}
+
+// decode accepts exactly one JSON object with the fields of CmdOutput
+func decode(data []byte, result *volumeplugin.CmdOutput) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	fields := map[string]json.RawMessage{}
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	var trailing json.RawMessage
+	if err := decoder.Decode(&trailing); err != io.EOF {
+		return errors.New("trailing data after JSON")
+	}
+	for field := range fields {
+		if !isOutputField(field) {
+			return fmt.Errorf("unknown field %q", field)
+		}
+	}
+	return json.Unmarshal(data, result)
+}
+
+// isOutputField matches field like encoding/json matches the fields of
+// CmdOutput, by tag or by name and ignoring case
+func isOutputField(field string) bool {
+	t := reflect.TypeOf(volumeplugin.CmdOutput{})
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func tail(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 512 {
+		return "..." + s[len(s)-512:]
+	}
+	return s
+}
+
+// loopDevices maps attached loop devices to their backing file
+func loopDevices() (map[string]string, error) {
+	result := map[string]string{}
+	files, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		backing, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		device := "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(file)))
+		result[device] = strings.TrimSpace(string(backing))
+	}
+	return result, nil
+}
@@ -0,0 +1,183 @@
+package volumeplugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	syncInterval   = time.Minute
+	minEventsRetry = time.Second
+	maxEventsRetry = 30 * time.Second
+)
+
+// watchContainerEvents keeps a subscription to the Docker events open for
+// the life of the plugin. Every subscription resumes from the last event
+// seen, and the mount tracking is synced with the running containers once
+// it is open to catch up on anything missed.
+func (d *RancherStorageDriver) watchContainerEvents() {
+	since := time.Now().UnixNano()
+	retry := minEventsRetry
+	for {
+		connected, err := d.watchEvents(&since)
+		if err == nil {
+			err = errors.New("events stream closed")
+		}
+		logrus.Errorf("Docker events: %v", err)
+		d.health.set(healthDockerEvents, err)
+
+		if connected {
+			retry = minEventsRetry
+		} else if retry *= 2; retry > maxEventsRetry {
+			retry = maxEventsRetry
+		}
+		time.Sleep(retry)
+	}
+}
+
+// watchEvents handles events until the stream fails, since is updated to the
+// time of the last event. It returns whether the stream was opened at all.
+func (d *RancherStorageDriver) watchEvents(since *int64) (bool, error) {
+	filter := filters.NewArgs()
+	filter.Add("type", events.ContainerEventType)
+	filter.Add("type", events.VolumeEventType)
+	for _, event := range []string{"start", "die", "stop", "destroy", "unmount"} {
+		filter.Add("event", event)
+	}
+
+	reader, err := d.cli.Events(context.Background(), types.EventsOptions{
+		Since:   fmt.Sprintf("%d.%09d", *since/int64(time.Second), *since%int64(time.Second)),
+		Filters: filter,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	d.health.set(healthDockerEvents, nil)
+	if err := d.syncMounts(); err != nil {
+		logrus.Errorf("Failed to sync mounts after subscribing to events: %v", err)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event events.Message
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			logrus.Errorf("Failed to unmarshal event %s: %v", scanner.Text(), err)
+			continue
+		}
+		at := event.TimeNano
+		if at == 0 {
+			at = event.Time * int64(time.Second)
+		}
+		if at > *since {
+			*since = at
+		}
+		d.handleEvent(event)
+	}
+	return true, scanner.Err()
+}
+
+func (d *RancherStorageDriver) handleEvent(event events.Message) {
+	switch {
+	case event.Type == events.ContainerEventType && event.Action == "start":
+		inspect, err := d.cli.ContainerInspect(context.Background(), event.Actor.ID)
+		if err != nil {
+			logrus.Errorf("failed to inspect new created container, err: %v", err)
+			return
+		}
+		d.mountMapLock.Lock()
+		for _, mount := range inspect.Mounts {
+			if strings.HasPrefix(mount.Source, d.getMntRoot()) {
+				d.addMount(mount.Source, event.Actor.ID)
+			}
+		}
+		d.saveMountRecord()
+		d.mountMapLock.Unlock()
+
+	case event.Type == events.ContainerEventType:
+		// die, stop or destroy, the container no longer uses its mounts
+		logrus.Infof("container %s %s", event.Actor.ID, event.Action)
+		d.mountMapLock.Lock()
+		for _, ids := range d.mountMap {
+			delete(ids, event.Actor.ID)
+		}
+		d.saveMountRecord()
+		d.mountMapLock.Unlock()
+		d.kickGC()
+
+	case event.Type == events.VolumeEventType && event.Action == "unmount":
+		if event.Actor.Attributes["driver"] != d.DriverName {
+			return
+		}
+		container := event.Actor.Attributes["container"]
+		logrus.Infof("volume %s unmounted from container %s", event.Actor.ID, container)
+		d.mountMapLock.Lock()
+		delete(d.mountMap[d.getMntDest(event.Actor.ID)], container)
+		d.saveMountRecord()
+		d.mountMapLock.Unlock()
+		d.kickGC()
+	}
+}
+
+// syncMountMap syncs the mount tracking periodically, in case events were
+// missed without the stream failing
+func (d *RancherStorageDriver) syncMountMap() {
+	for {
+		time.Sleep(syncInterval)
+		if err := d.syncMounts(); err != nil {
+			logrus.Errorf("Failed to sync mounts: %v", err)
+		}
+	}
+}
+
+// syncMounts makes the running containers the users of the mounts
+func (d *RancherStorageDriver) syncMounts() error {
+	containers, err := d.cli.ContainerList(context.Background(), types.ContainerListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "listing containers")
+	}
+
+	running := map[string]bool{}
+	for _, container := range containers {
+		running[container.ID] = true
+	}
+
+	d.mountMapLock.Lock()
+	// the first sync after a start without Docker lets the GC unmount
+	removed := !d.mountsSynced
+	d.mountsSynced = true
+	for _, ids := range d.mountMap {
+		for id := range ids {
+			if !running[id] {
+				delete(ids, id)
+				removed = true
+			}
+		}
+	}
+	for _, container := range containers {
+		for _, mount := range container.Mounts {
+			if strings.HasPrefix(mount.Source, d.getMntRoot()) {
+				d.addMount(mount.Source, container.ID)
+			}
+		}
+	}
+	d.saveMountRecord()
+	d.mountMapLock.Unlock()
+
+	if removed {
+		d.kickGC()
+	}
+	return nil
+}
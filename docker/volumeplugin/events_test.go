@@ -0,0 +1,79 @@
+package volumeplugin
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+)
+
+func TestHandleEvent(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	// the events are handled here rather than streamed
+	d := e.driverWithoutDocker(e.localState())
+	cli, err := e.server.DockerClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.cli = cli
+	data := d.getMntDest("data")
+
+	e.server.SetContainers([]types.Container{
+		{ID: "c2", Mounts: []types.MountPoint{{Source: data}}},
+		{ID: "c3", Mounts: []types.MountPoint{{Source: "/var/lib/docker/volumes/local"}}},
+	})
+
+	unmount := func(driver string) events.Message {
+		return events.Message{
+			Type:   events.VolumeEventType,
+			Action: "unmount",
+			Actor: events.Actor{
+				ID:         "data",
+				Attributes: map[string]string{"driver": driver, "container": "c1"},
+			},
+		}
+	}
+	container := func(action, id string) events.Message {
+		return events.Message{
+			Type:   events.ContainerEventType,
+			Action: action,
+			Actor:  events.Actor{ID: id},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		event events.Message
+		want  []string
+	}{
+		{name: "start", event: container("start", "c2"), want: []string{"c1", "c2"}},
+		{name: "start without the volume", event: container("start", "c3"), want: []string{"c1"}},
+		{name: "die", event: container("die", "c1"), want: []string{}},
+		{name: "stop", event: container("stop", "c1"), want: []string{}},
+		{name: "destroy", event: container("destroy", "c1"), want: []string{}},
+		{name: "unmount", event: unmount("rancher-loop"), want: []string{}},
+		{name: "unmount of another driver", event: unmount("local"), want: []string{"c1"}},
+	}
+
+	for _, test := range tests {
+		d.mountMapLock.Lock()
+		d.mountMap = map[string]map[string]struct{}{data: {"c1": {}}}
+		d.mountMapLock.Unlock()
+
+		d.handleEvent(test.event)
+
+		d.mountMapLock.Lock()
+		got := []string{}
+		for id := range d.mountMap[data] {
+			got = append(got, id)
+		}
+		d.mountMapLock.Unlock()
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected the users of data to be %v, got %v", test.name, test.want, got)
+		}
+	}
+}
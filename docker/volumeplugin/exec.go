@@ -3,51 +3,285 @@ package volumeplugin
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
-	"os"
 	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 )
 
 const (
 	statusSuccess      = "Success"
 	statusFailure      = "Failure"
 	statusNotSupported = "Not supported"
+
+	// DefaultScriptTimeout bounds every call of a driver script, attaching
+	// a cloud volume can take a few minutes.
+	DefaultScriptTimeout = 10 * time.Minute
 )
 
-var errNotSupported = errors.New("Unsupported Operation")
+// killWait bounds how long a killed script may take to exit
+var killWait = 30 * time.Second
+
+// errUnkillable is returned by run for a script that did not exit once killed
+var errUnkillable = errors.New("The script did not exit once killed")
 
 type CmdOutput struct {
-	Status  string
-	Message string
-	Options map[string]string
-	Device  string `json:"device"`
+	Status    string
+	Message   string
+	Options   map[string]string
+	Device    string          `json:"device"`
+	Snapshot  *Snapshot       `json:"snapshot"`
+	Snapshots []Snapshot      `json:"snapshots"`
+	Volumes   []BackendVolume `json:"volumes"`
+}
+
+// ScriptBackend is a Backend implemented by an external executable that
+// follows the contract in package/common/common.sh.
+type ScriptBackend struct {
+	Command string
+	// Timeout is how long a call may run before the script and everything
+	// it started is killed, 0 for no limit
+	Timeout time.Duration
+	// Timeouts overrides Timeout by subcommand, for example mount
+	Timeouts map[string]time.Duration
+	// Context cancels every running call when it is done
+	Context context.Context
+}
+
+func NewScriptBackend(command string) *ScriptBackend {
+	return &ScriptBackend{
+		Command:  command,
+		Timeout:  DefaultScriptTimeout,
+		Timeouts: map[string]time.Duration{},
+		Context:  context.Background(),
+	}
+}
+
+func (s *ScriptBackend) Init() error {
+	_, err := s.exec("init", "")
+	return err
+}
+
+func (s *ScriptBackend) Create(name string, options map[string]string) (map[string]string, error) {
+	output, err := s.exec("create", name, toArgs(name, options))
+	return output.Options, err
+}
+
+func (s *ScriptBackend) Delete(name string, options map[string]string) error {
+	_, err := s.exec("delete", name, toArgs(name, options))
+	return err
+}
+
+func (s *ScriptBackend) Attach(name string, options map[string]string) (string, error) {
+	output, err := s.exec("attach", name, toArgs(name, options))
+	return output.Device, err
+}
+
+func (s *ScriptBackend) Detach(device string) error {
+	_, err := s.exec("detach", "", device)
+	return err
 }
 
-func (d *RancherStorageDriver) exec(command string, args ...string) (CmdOutput, error) {
-	result := CmdOutput{}
+func (s *ScriptBackend) Mount(mntDest, device, name string, options map[string]string) error {
+	_, err := s.exec("mount", name, mntDest, device, toArgs(name, options))
+	return err
+}
+
+func (s *ScriptBackend) Unmount(mntDest string) error {
+	_, err := s.exec("unmount", "", mntDest)
+	return err
+}
+
+func (s *ScriptBackend) Snapshot(name, snapshotName string, options map[string]string) (*Snapshot, error) {
+	output, err := s.exec("snapshot", name, toArgs(name, Fold(options, map[string]string{
+		"snapshotName": snapshotName,
+	})))
+	return output.Snapshot, err
+}
+
+func (s *ScriptBackend) ListSnapshots(name string, options map[string]string) ([]Snapshot, error) {
+	output, err := s.exec("list-snapshots", name, toArgs(name, options))
+	return output.Snapshots, err
+}
+
+func (s *ScriptBackend) DeleteSnapshot(name, snapshotID string, options map[string]string) error {
+	_, err := s.exec("delete-snapshot", name, toArgs(name, Fold(options, map[string]string{
+		"snapshotID": snapshotID,
+	})))
+	return err
+}
+
+func (s *ScriptBackend) Resize(name, size, mntDest string, options map[string]string) error {
+	_, err := s.exec("resize", name, toArgs(name, Fold(options, map[string]string{
+		"newSize":    size,
+		"mountPoint": mntDest,
+	})))
+	return err
+}
+
+func (s *ScriptBackend) Clone(name string, options map[string]string, source string, sourceOptions map[string]string) (map[string]string, error) {
+	output, err := s.exec("clone", name, toArgs(name, options), toArgs(source, sourceOptions))
+	return output.Options, err
+}
+
+func (s *ScriptBackend) Archive(name string, options map[string]string) error {
+	_, err := s.exec("archive", name, toArgs(name, options))
+	return err
+}
+
+func (s *ScriptBackend) Import(name string, options map[string]string) (map[string]string, error) {
+	output, err := s.exec("import", name, toArgs(name, options))
+	return output.Options, err
+}
+
+func (s *ScriptBackend) Trash(name string, options map[string]string) (map[string]string, error) {
+	output, err := s.exec("trash", name, toArgs(name, options))
+	return output.Options, err
+}
+
+func (s *ScriptBackend) Restore(name string, options map[string]string, trashedName string, trashed map[string]string) (map[string]string, error) {
+	output, err := s.exec("restore", name, toArgs(name, options), toArgs(trashedName, trashed))
+	return output.Options, err
+}
+
+func (s *ScriptBackend) List(options map[string]string) ([]BackendVolume, error) {
+	if options == nil {
+		options = map[string]string{}
+	}
+	bytes, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.exec("list", "", string(bytes))
+	return output.Volumes, err
+}
+
+// exec calls the script, name is the volume the call is for, if any, and is
+// only used to log the stderr of the script.
+func (s *ScriptBackend) exec(command, name string, args ...string) (result CmdOutput, err error) {
+	start := time.Now()
+	defer func() {
+		observeExec(command, start, err)
+	}()
+
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := s.timeout(command)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	fields := logrus.Fields{
+		"driver":  s.Command,
+		"command": command,
+	}
+	if name != "" {
+		fields["volume"] = name
+	}
+	stderr := newStderrLogger(fields)
+
 	buf := &bytes.Buffer{}
-	cmd := exec.Command(d.Command, append([]string{command}, args...)...)
-	cmd.Stderr = os.Stderr
+	cmd := exec.Command(s.Command, append([]string{command}, args...)...)
+	cmd.Stderr = stderr
 	cmd.Stdout = buf
+	// The script runs in its own process group so mount, losetup or a cloud
+	// CLI it started are killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	runErr := run(ctx, cmd)
+	if runErr == errUnkillable {
+		// The script still writes its output, which is then not read
+		logrus.WithFields(fields).Errorf("Leaving %s %s behind, it did not exit %v after it was killed", s.Command, command, killWait)
+		if ctx.Err() == context.DeadlineExceeded {
+			return result, &TimeoutError{Op: command, Timeout: timeout}
+		}
+		return result, &DriverError{Op: command, Message: ctx.Err().Error()}
+	}
+	stderr.Flush()
 
-	if err := cmd.Run(); err != nil {
-		if json.Unmarshal(buf.Bytes(), &result) == nil && result.Message != "" {
-			return result, errors.New(result.Message)
+	exitCode := 0
+	if exitErr, ok := runErr.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			exitCode = status.ExitStatus()
 		}
-		return result, err
 	}
+	// a failed script may not print its result, its exit is reported then
+	parseErr := json.Unmarshal(buf.Bytes(), &result)
 
-	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
-		return result, err
+	entry := logrus.WithFields(fields).WithFields(logrus.Fields{
+		"status":   result.Status,
+		"message":  result.Message,
+		"duration": time.Since(start),
+		"exitCode": exitCode,
+	})
+	if runErr != nil {
+		entry.WithError(runErr).Error("exec.result")
+	} else {
+		entry.Debug("exec.result")
+	}
+
+	if runErr == context.DeadlineExceeded {
+		return result, &TimeoutError{Op: command, Timeout: timeout}
+	} else if runErr != nil {
+		if result.Message != "" {
+			return result, &DriverError{Op: command, Message: result.Message, Stderr: stderr.Tail()}
+		}
+		return result, &DriverError{Op: command, Message: runErr.Error(), Stderr: stderr.Tail()}
+	}
+
+	if parseErr != nil {
+		return result, errors.Wrapf(parseErr, "parsing output of %s %q", command, buf.String())
 	}
 
 	if result.Status == statusFailure {
-		return result, errors.New(result.Message)
+		return result, &DriverError{Op: command, Message: result.Message, Stderr: stderr.Tail()}
 	}
 
 	if result.Status == statusNotSupported {
-		return result, errNotSupported
+		return result, ErrNotSupported
 	}
 
 	return result, nil
 }
+
+func (s *ScriptBackend) timeout(command string) time.Duration {
+	if timeout, ok := s.Timeouts[command]; ok {
+		return timeout
+	}
+	return s.Timeout
+}
+
+// run kills the process group of cmd when ctx is done and returns the error
+// of ctx in that case. A process blocked in the kernel, on an unreachable NFS
+// server for example, ignores SIGKILL, run then returns errUnkillable after
+// killWait and cmd is reaped in the background when it exits.
+func run(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		select {
+		case <-done:
+			return ctx.Err()
+		case <-time.After(killWait):
+			return errUnkillable
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package volumeplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecReturnsWhenKilledScriptHangs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the sleep left in its own session keeps the output of the script open
+	// after the kill, like a mount stuck on a dead server
+	script := filepath.Join(dir, "rancher-hang")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/bash\nsetsid sleep 5 &\nsleep 5\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(wait time.Duration) { killWait = wait }(killWait)
+	killWait = 100 * time.Millisecond
+
+	s := NewScriptBackend(script)
+	s.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	err = s.Init()
+	if err == nil || !IsTimeout(err.Error()) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected exec to return once the kill wait is over, it took %v", elapsed)
+	}
+}
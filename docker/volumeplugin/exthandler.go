@@ -7,11 +7,25 @@ import (
 )
 
 const (
-	attachPath = "/VolumeDriver.Attach"
+	attachPath         = "/VolumeDriver.Attach"
+	snapshotPath       = "/VolumeDriver.Snapshot"
+	listSnapshotsPath  = "/VolumeDriver.ListSnapshots"
+	deleteSnapshotPath = "/VolumeDriver.DeleteSnapshot"
+	resizePath         = "/VolumeDriver.Resize"
+	importPath         = "/VolumeDriver.Import"
+	listTrashPath      = "/VolumeDriver.ListTrash"
+	undeletePath       = "/VolumeDriver.Undelete"
 )
 
 type ExtDriver interface {
 	Attach(AttachRequest) volume.Response
+	Snapshot(SnapshotRequest) SnapshotResponse
+	ListSnapshots(SnapshotRequest) SnapshotResponse
+	DeleteSnapshot(SnapshotRequest) SnapshotResponse
+	Resize(ResizeRequest) volume.Response
+	Import(volume.Request) volume.Response
+	ListTrash(UndeleteRequest) TrashResponse
+	Undelete(UndeleteRequest) volume.Response
 }
 
 type AttachRequest struct {
@@ -20,11 +34,37 @@ type AttachRequest struct {
 }
 
 type attachActionHandler func(AttachRequest) volume.Response
+type snapshotActionHandler func(SnapshotRequest) SnapshotResponse
+type resizeActionHandler func(ResizeRequest) volume.Response
+type importActionHandler func(volume.Request) volume.Response
+type listTrashActionHandler func(UndeleteRequest) TrashResponse
+type undeleteActionHandler func(UndeleteRequest) volume.Response
 
 func ExtendHandler(h *volume.Handler, d ExtDriver) {
 	handleAttach(h, attachPath, func(req AttachRequest) volume.Response {
 		return d.Attach(req)
 	})
+	handleSnapshot(h, snapshotPath, func(req SnapshotRequest) SnapshotResponse {
+		return d.Snapshot(req)
+	})
+	handleSnapshot(h, listSnapshotsPath, func(req SnapshotRequest) SnapshotResponse {
+		return d.ListSnapshots(req)
+	})
+	handleSnapshot(h, deleteSnapshotPath, func(req SnapshotRequest) SnapshotResponse {
+		return d.DeleteSnapshot(req)
+	})
+	handleResize(h, resizePath, func(req ResizeRequest) volume.Response {
+		return d.Resize(req)
+	})
+	handleImport(h, importPath, func(req volume.Request) volume.Response {
+		return d.Import(req)
+	})
+	handleListTrash(h, listTrashPath, func(req UndeleteRequest) TrashResponse {
+		return d.ListTrash(req)
+	})
+	handleUndelete(h, undeletePath, func(req UndeleteRequest) volume.Response {
+		return d.Undelete(req)
+	})
 }
 
 func handleAttach(h *volume.Handler, name string, actionCall attachActionHandler) {
@@ -37,3 +77,58 @@ func handleAttach(h *volume.Handler, name string, actionCall attachActionHandler
 		sdk.EncodeResponse(w, res, res.Err)
 	})
 }
+
+func handleSnapshot(h *volume.Handler, name string, actionCall snapshotActionHandler) {
+	h.HandleFunc(name, func(w http.ResponseWriter, r *http.Request) {
+		var req SnapshotRequest
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		res := actionCall(req)
+		sdk.EncodeResponse(w, res, res.Err)
+	})
+}
+
+func handleResize(h *volume.Handler, name string, actionCall resizeActionHandler) {
+	h.HandleFunc(name, func(w http.ResponseWriter, r *http.Request) {
+		var req ResizeRequest
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		res := actionCall(req)
+		sdk.EncodeResponse(w, res, res.Err)
+	})
+}
+
+func handleImport(h *volume.Handler, name string, actionCall importActionHandler) {
+	h.HandleFunc(name, func(w http.ResponseWriter, r *http.Request) {
+		var req volume.Request
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		res := actionCall(req)
+		sdk.EncodeResponse(w, res, res.Err)
+	})
+}
+
+func handleListTrash(h *volume.Handler, name string, actionCall listTrashActionHandler) {
+	h.HandleFunc(name, func(w http.ResponseWriter, r *http.Request) {
+		var req UndeleteRequest
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		res := actionCall(req)
+		sdk.EncodeResponse(w, res, res.Err)
+	})
+}
+
+func handleUndelete(h *volume.Handler, name string, actionCall undeleteActionHandler) {
+	h.HandleFunc(name, func(w http.ResponseWriter, r *http.Request) {
+		var req UndeleteRequest
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		res := actionCall(req)
+		sdk.EncodeResponse(w, res, res.Err)
+	})
+}
@@ -0,0 +1,446 @@
+// Package fakerancher is an in memory fake of the parts of a Rancher host the
+// plugin talks to: the subset of the Cattle v2 API used by RancherState, the
+// self/host endpoint of the metadata service and the Docker API calls made to
+// track mounts. It lets the plugin run hermetically, for example against
+// rancher-loop with a mount.FakeMounter.
+package fakerancher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	dockerClient "github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/go-rancher/v2"
+)
+
+const (
+	apiPath      = "/v2-beta"
+	metadataPath = "/metadata"
+	dockerPath   = "/docker"
+)
+
+// Server serves the fake APIs on a local port until it is closed.
+type Server struct {
+	lock     sync.Mutex
+	server   *httptest.Server
+	closed   chan struct{}
+	nextID   int
+	volumes  []*client.Volume
+	drivers  []*client.StorageDriver
+	hosts    []*client.Host
+	selfHost metadata.Host
+
+	containers []types.Container
+	streams    map[chan events.Message]bool
+	streamed   int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		closed:  make(chan struct{}),
+		streams: map[chan events.Message]bool{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPath, s.serveRoot)
+	mux.HandleFunc(apiPath+"/schemas", s.serveSchemas)
+	mux.HandleFunc(apiPath+"/volumes", s.serveVolumes)
+	mux.HandleFunc(apiPath+"/volumes/", s.serveVolume)
+	mux.HandleFunc(apiPath+"/storagedrivers", s.serveDrivers)
+	mux.HandleFunc(apiPath+"/hosts", s.serveHosts)
+	mux.HandleFunc(metadataPath+"/version", s.serveVersion)
+	mux.HandleFunc(metadataPath+"/self/host", s.serveSelfHost)
+	mux.HandleFunc(dockerPath+"/", s.serveDocker)
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *Server) Close() {
+	close(s.closed)
+	s.server.Close()
+}
+
+// URL is the Cattle URL to pass to client.NewRancherClient
+func (s *Server) URL() string {
+	return s.server.URL + apiPath
+}
+
+// MetadataURL is the metadata URL to pass to volumeplugin.NewRancherState
+func (s *Server) MetadataURL() string {
+	return s.server.URL + metadataPath
+}
+
+// DockerHost is the host to pass to the Docker client. Only the container
+// list, the event stream and info are served.
+func (s *Server) DockerHost() string {
+	return "tcp://" + s.server.Listener.Addr().String() + dockerPath
+}
+
+func (s *Server) Client() (*client.RancherClient, error) {
+	return client.NewRancherClient(&client.ClientOpts{
+		Url: s.URL(),
+	})
+}
+
+func (s *Server) DockerClient() (*dockerClient.Client, error) {
+	return dockerClient.NewClient(s.DockerHost(), "v1.22", nil, nil)
+}
+
+// SetContainers sets the running containers listed by Docker
+func (s *Server) SetContainers(containers []types.Container) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.containers = containers
+}
+
+// SendEvent sends event to every open event stream
+func (s *Server) SendEvent(event events.Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for stream := range s.streams {
+		stream <- event
+	}
+}
+
+// EventStreams counts the event streams opened so far
+func (s *Server) EventStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streamed
+}
+
+// CloseEventStreams ends the open event streams like a restart of Docker
+func (s *Server) CloseEventStreams() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for stream := range s.streams {
+		close(stream)
+		delete(s.streams, stream)
+	}
+}
+
+// AddDriver registers a storage driver and returns its ID
+func (s *Server) AddDriver(name string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	driver := &client.StorageDriver{
+		Resource: s.resource("storageDriver", "storagedrivers"),
+		Name:     name,
+		State:    "active",
+	}
+	s.drivers = append(s.drivers, driver)
+	return driver.Id
+}
+
+// AddHost registers the host the plugin runs on and returns its ID
+func (s *Server) AddHost(uuid, hostname string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	host := &client.Host{
+		Resource: s.resource("host", "hosts"),
+		Uuid:     uuid,
+		Hostname: hostname,
+		State:    "active",
+	}
+	s.hosts = append(s.hosts, host)
+	s.selfHost = metadata.Host{
+		UUID:     uuid,
+		Hostname: hostname,
+	}
+	return host.Id
+}
+
+// AddVolume creates the volume record Cattle makes before calling the plugin,
+// RancherState.Save waits for it.
+func (s *Server) AddVolume(name, driver, driverID, state string) *client.Volume {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	copy := *s.addVolume(name, driver, driverID, state)
+	return &copy
+}
+
+// addVolume must be called with the lock held
+func (s *Server) addVolume(name, driver, driverID, state string) *client.Volume {
+	vol := &client.Volume{
+		Resource:        s.resource("volume", "volumes"),
+		Name:            name,
+		Driver:          driver,
+		StorageDriverId: driverID,
+		State:           state,
+		Created:         time.Now().UTC().Format(time.RFC3339),
+	}
+	vol.Actions = map[string]string{
+		"update": vol.Links["self"] + "?action=update",
+	}
+	s.volumes = append(s.volumes, vol)
+	return vol
+}
+
+// SetVolumeState moves a volume to state, for example removing before a
+// Docker removal or removed to purge it
+func (s *Server) SetVolumeState(name, state string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, vol := range s.volumes {
+		if vol.Name == name && vol.Removed == "" {
+			vol.State = state
+			if state == "removed" || state == "purged" {
+				vol.Removed = time.Now().UTC().Format(time.RFC3339)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("No volume %s", name)
+}
+
+// Volume returns a copy of the volume that is not removed, if any
+func (s *Server) Volume(name string) *client.Volume {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, vol := range s.volumes {
+		if vol.Name == name && vol.Removed == "" {
+			copy := *vol
+			return &copy
+		}
+	}
+	return nil
+}
+
+// resource must be called with the lock held
+func (s *Server) resource(kind, collection string) client.Resource {
+	s.nextID++
+	id := fmt.Sprintf("1%s%d", kind[:1], s.nextID)
+	return client.Resource{
+		Id:   id,
+		Type: kind,
+		Links: map[string]string{
+			"self": s.URL() + "/" + collection + "/" + id,
+		},
+		Actions: map[string]string{},
+	}
+}
+
+func (s *Server) serveRoot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Schemas", s.URL()+"/schemas")
+	writeJSON(w, map[string]string{"type": "apiRoot"})
+}
+
+func (s *Server) serveSchemas(w http.ResponseWriter, r *http.Request) {
+	schema := func(id, collection string) client.Schema {
+		return client.Schema{
+			Resource: client.Resource{
+				Id:   id,
+				Type: "schema",
+				Links: map[string]string{
+					"collection": s.URL() + "/" + collection,
+				},
+			},
+			CollectionMethods: []string{"GET", "POST"},
+			ResourceMethods:   []string{"GET", "PUT"},
+		}
+	}
+	writeJSON(w, client.Schemas{
+		Data: []client.Schema{
+			schema("volume", "volumes"),
+			schema("storageDriver", "storagedrivers"),
+			schema("host", "hosts"),
+		},
+	})
+}
+
+func (s *Server) serveVolumes(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r.Method == "POST" {
+		create := &client.Volume{}
+		if err := json.NewDecoder(r.Body).Decode(create); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		vol := s.addVolume(create.Name, create.Driver, create.StorageDriverId, "inactive")
+		vol.HostId = create.HostId
+		vol.DriverOpts = create.DriverOpts
+		writeJSON(w, vol)
+		return
+	}
+
+	q := r.URL.Query()
+	result := client.VolumeCollection{Data: []client.Volume{}}
+	for _, vol := range s.volumes {
+		if !matches(q, "name", vol.Name) ||
+			!matches(q, "driver", vol.Driver) ||
+			!matches(q, "storageDriverId", vol.StorageDriverId) ||
+			(q.Get("removed_null") != "" && vol.Removed != "") {
+			continue
+		}
+		result.Data = append(result.Data, *vol)
+	}
+	writeJSON(w, result)
+}
+
+func (s *Server) serveVolume(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, apiPath+"/volumes/")
+	var vol *client.Volume
+	for _, v := range s.volumes {
+		if v.Id == id {
+			vol = v
+		}
+	}
+	if vol == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == "PUT":
+		resource := vol.Resource
+		if err := json.NewDecoder(r.Body).Decode(vol); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		vol.Resource = resource
+	case r.Method == "POST" && r.URL.Query().Get("action") == "update":
+		vol.State = "active"
+	case r.Method != "GET":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, vol)
+}
+
+func (s *Server) serveDrivers(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q := r.URL.Query()
+	result := client.StorageDriverCollection{Data: []client.StorageDriver{}}
+	for _, driver := range s.drivers {
+		if matches(q, "name", driver.Name) {
+			result.Data = append(result.Data, *driver)
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (s *Server) serveHosts(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q := r.URL.Query()
+	result := client.HostCollection{Data: []client.Host{}}
+	for _, host := range s.hosts {
+		if matches(q, "uuid", host.Uuid) {
+			result.Data = append(result.Data, *host)
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (s *Server) serveVersion(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "2015-12-19")
+}
+
+func (s *Server) serveSelfHost(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.selfHost.UUID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, s.selfHost)
+}
+
+func (s *Server) serveDocker(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/containers/json"):
+		s.lock.Lock()
+		containers := append([]types.Container{}, s.containers...)
+		s.lock.Unlock()
+		writeJSON(w, containers)
+	case strings.Contains(r.URL.Path, "/containers/") && strings.HasSuffix(r.URL.Path, "/json"):
+		s.serveContainer(w, r)
+	case strings.HasSuffix(r.URL.Path, "/events"):
+		s.serveEvents(w, r)
+	case strings.HasSuffix(r.URL.Path, "/info"):
+		writeJSON(w, map[string]string{"ID": "fakerancher"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveContainer inspects one of the containers set with SetContainers
+func (s *Server) serveContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(r.URL.Path, "/json")
+	id = id[strings.LastIndex(id, "/")+1:]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, container := range s.containers {
+		if container.ID == id {
+			writeJSON(w, types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{ID: id},
+				Mounts:            container.Mounts,
+			})
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveEvents streams the events sent after it was opened, filters and since
+// are ignored
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	stream := make(chan events.Message, 16)
+	s.lock.Lock()
+	s.streams[stream] = true
+	s.streamed++
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		if s.streams[stream] {
+			delete(s.streams, stream)
+		}
+		s.lock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				return
+			}
+			encoder.Encode(event)
+			w.(http.Flusher).Flush()
+		case <-s.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func matches(q url.Values, key, value string) bool {
+	filter, ok := q[key]
+	return !ok || filter[0] == value
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
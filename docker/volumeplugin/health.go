@@ -0,0 +1,132 @@
+package volumeplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	healthDockerEvents = "docker-events"
+	healthState        = "state"
+	healthDriver       = "driver"
+
+	// The driver init can be expensive, rancher-nfs mounts the export
+	driverCheckInterval = time.Minute
+)
+
+type componentHealth struct {
+	Component string `json:"component"`
+	Error     string `json:"error"`
+}
+
+type healthResponse struct {
+	Status  string            `json:"status"`
+	Failing []componentHealth `json:"failing,omitempty"`
+}
+
+type health struct {
+	sync.RWMutex
+	failures map[string]string
+}
+
+func (h *health) set(component string, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.failures == nil {
+		h.failures = map[string]string{}
+	}
+	if err == nil {
+		if _, ok := h.failures[component]; ok {
+			logrus.Infof("Health of %s recovered", component)
+			delete(h.failures, component)
+		}
+		return
+	}
+	if _, ok := h.failures[component]; !ok {
+		logrus.Errorf("Health of %s degraded: %v", component, err)
+	}
+	h.failures[component] = err.Error()
+}
+
+func (h *health) get() healthResponse {
+	h.RLock()
+	defer h.RUnlock()
+	result := healthResponse{
+		Status: "ok",
+	}
+	for component, err := range h.failures {
+		result.Failing = append(result.Failing, componentHealth{
+			Component: component,
+			Error:     err,
+		})
+	}
+	sort.Slice(result.Failing, func(i, j int) bool {
+		return result.Failing[i].Component < result.Failing[j].Component
+	})
+	if len(result.Failing) > 0 {
+		result.Status = "degraded"
+	}
+	return result
+}
+
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := h.get()
+	w.Header().Set("Content-Type", "application/json")
+	if len(result.Failing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// Healthy returns an error naming the failing components, if any.
+func (d *RancherStorageDriver) Healthy() error {
+	result := d.health.get()
+	if len(result.Failing) == 0 {
+		return nil
+	}
+	var failing []string
+	for _, f := range result.Failing {
+		failing = append(failing, fmt.Sprintf("%s: %s", f.Component, f.Error))
+	}
+	return fmt.Errorf("Unhealthy, %s", strings.Join(failing, ", "))
+}
+
+// StartHealthCheck serves /healthcheck on port, reporting degraded while the
+// Docker events stream is down, the state store can not be reached or the
+// driver can no longer initialize. The state store is checked every interval,
+// the driver at most every driverCheckInterval.
+func (d *RancherStorageDriver) StartHealthCheck(port int, interval time.Duration) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("Invalid health check port number: %v", port)
+	}
+
+	go d.runHealthChecks(interval)
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthcheck", &d.health)
+	p := ":" + strconv.Itoa(port)
+	logrus.Infof("Listening for health checks on 0.0.0.0%v/healthcheck", p)
+	return http.ListenAndServe(p, mux)
+}
+
+func (d *RancherStorageDriver) runHealthChecks(interval time.Duration) {
+	var lastDriverCheck time.Time
+	for {
+		d.health.set(healthState, d.state.ping())
+
+		if time.Since(lastDriverCheck) >= driverCheckInterval {
+			d.health.set(healthDriver, d.Backend.Init())
+			lastDriverCheck = time.Now()
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,81 @@
+package volumeplugin
+
+import (
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/pkg/errors"
+)
+
+// ownershipOption records whether the driver created the storage of a volume
+// or it was imported. The storage of adopted volumes is kept on removal.
+const (
+	ownershipOption  = "ownership"
+	ownershipCreated = "created"
+	ownershipAdopted = "adopted"
+)
+
+// Importer is implemented by backends that can adopt storage that was not
+// created by the plugin. Import fails if the storage does not exist or is
+// attached to another host, and returns the options to persist.
+type Importer interface {
+	Import(name string, options map[string]string) (map[string]string, error)
+}
+
+// Import records existing storage, described by the options of the request,
+// as the volume of the request
+func (d *RancherStorageDriver) Import(request volume.Request) volume.Response {
+	defer d.lockVolume(request.Name)()
+
+	logRequest("import", &request)
+
+	response := volume.Response{}
+	defer logResponse("import", request.Name, &response)
+	defer observeOperation("import", time.Now(), &response.Err)
+
+	if err := ImportVolume(d.Backend, d.state, request.Name, request.Options); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+// ImportVolume verifies the storage described by options with backend and
+// saves it in state as the adopted volume name
+func ImportVolume(backend Backend, state StateStore, name string, options map[string]string) error {
+	if name == "" {
+		return errors.New("name is required")
+	}
+
+	i, ok := backend.(Importer)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	if created, err := state.IsCreated(name); err != nil {
+		return err
+	} else if created {
+		return errors.Errorf("Volume %s already exists", name)
+	}
+
+	imported, err := i.Import(name, Fold(options))
+	if err != nil {
+		return err
+	}
+
+	result := Fold(options, imported, map[string]string{ownershipOption: ownershipAdopted})
+	// drivers delete the storage of volumes they created
+	delete(result, "created")
+	return state.add(name, result)
+}
+
+// ownership marks the volumes whose storage the driver reported creating
+func ownership(options map[string]string) map[string]string {
+	if options["created"] == "true" {
+		return map[string]string{ownershipOption: ownershipCreated}
+	}
+	return nil
+}
+
+func isAdopted(options map[string]string) bool {
+	return options[ownershipOption] == ownershipAdopted
+}
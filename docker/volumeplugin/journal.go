@@ -0,0 +1,338 @@
+package volumeplugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	journalCreate = "create"
+	journalDelete = "delete"
+	journalAttach = "attach"
+)
+
+// journalEntry is an operation on the backend that was started and is not
+// recorded in the state or the mount tracking yet.
+type journalEntry struct {
+	Op      string            `json:"op"`
+	Name    string            `json:"name"`
+	Options map[string]string `json:"options"`
+	// Done is set once the backend finished the operation
+	Done bool `json:"done"`
+	// Adopted identifies the storage of the name that existed before a
+	// create, which it adopts rather than provisions and is not undone
+	Adopted []string `json:"adopted,omitempty"`
+	// Policy is the reclaim policy a delete applies
+	Policy string `json:"policy,omitempty"`
+	// MntDest is the mount an attach is for
+	MntDest string    `json:"mntDest,omitempty"`
+	Started time.Time `json:"started"`
+	// retry is set when an entry of an earlier attempt was still journaled
+	retry bool
+}
+
+// journal is written ahead of backend operations that provision or attach
+// storage, so storage the plugin did not get to record before a crash is
+// found on the next start.
+type journal struct {
+	dir string
+}
+
+func newJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating %s", dir)
+	}
+	return &journal{dir: dir}, nil
+}
+
+func (j *journal) file(e *journalEntry) string {
+	return filepath.Join(j.dir, e.Op+"-"+e.Name+".json")
+}
+
+// begin records e before the backend is called. A retry keeps the storage
+// the first attempt found, what that attempt left is not adopted.
+func (j *journal) begin(e *journalEntry) error {
+	if bytes, err := ioutil.ReadFile(j.file(e)); err == nil {
+		e.retry = true
+		earlier := &journalEntry{}
+		if err := json.Unmarshal(bytes, earlier); err == nil {
+			e.Adopted = earlier.Adopted
+		}
+	}
+	e.Started = time.Now().UTC()
+	return errors.Wrapf(j.update(e), "journaling %s of %s", e.Op, e.Name)
+}
+
+func (j *journal) update(e *journalEntry) error {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(j.file(e), bytes)
+}
+
+// finish forgets e once its outcome is recorded elsewhere
+func (j *journal) finish(e *journalEntry) {
+	if err := os.Remove(j.file(e)); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("Failed to remove journal entry %s: %v", j.file(e), err)
+	}
+}
+
+// abort forgets e when the driver reported that the operation failed. After
+// a timeout, or any other error, the driver may still have completed it and
+// e is kept for the replay on the next start, as is the entry of an earlier
+// attempt that did not finish.
+func (j *journal) abort(e *journalEntry, err error) {
+	_, failed := errors.Cause(err).(*DriverError)
+	if (failed || err == ErrNotSupported) && !e.retry {
+		j.finish(e)
+		return
+	}
+	logrus.Warnf("Keeping the journal entry of %s of %s to undo it on the next start: %v", e.Op, e.Name, err)
+}
+
+func (j *journal) entries() ([]*journalEntry, error) {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*journalEntry
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(j.dir, file.Name())
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		e := &journalEntry{}
+		if err := json.Unmarshal(bytes, e); err != nil {
+			logrus.Errorf("Ignoring unreadable journal entry %s: %v", path, err)
+			continue
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// writeFileSync replaces file with data so that either the old or the new
+// content survives a crash
+func writeFileSync(file string, data []byte) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (d *RancherStorageDriver) journalDir() string {
+	return filepath.Join(d.Basedir, state, d.DriverName+"-journal")
+}
+
+// replayJournal finishes or undoes the operations that were interrupted by
+// a crash. Entries that fail to replay are kept for the next start.
+func (d *RancherStorageDriver) replayJournal() error {
+	entries, err := d.journal.entries()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		logrus.Infof("Replaying %s of %s started %v", e.Op, e.Name, e.Started)
+		var err error
+		switch e.Op {
+		case journalCreate:
+			err = d.replayCreate(e)
+		case journalDelete:
+			err = d.replayDelete(e)
+		case journalAttach:
+			err = d.replayAttach(e)
+		default:
+			logrus.Errorf("Ignoring journal entry of unknown operation %s", e.Op)
+		}
+		if err != nil {
+			logrus.Errorf("Failed to replay %s of %s, retrying on the next start: %v", e.Op, e.Name, err)
+			continue
+		}
+		d.journal.finish(e)
+	}
+	return nil
+}
+
+// replayCreate saves a volume the backend created, or deletes it again if it
+// can not be saved
+func (d *RancherStorageDriver) replayCreate(e *journalEntry) error {
+	if created, err := d.state.IsCreated(e.Name); err != nil {
+		return err
+	} else if created {
+		return nil
+	}
+
+	if !e.Done {
+		return d.undoCreate(e)
+	}
+
+	err := d.state.Save(e.Name, e.Options, 0)
+	if err == nil {
+		return nil
+	}
+	logrus.Errorf("Failed to save %s, deleting it: %v", e.Name, err)
+	if err := d.Backend.Delete(e.Name, e.Options); err != nil && err != ErrNotSupported {
+		return errors.Wrapf(err, "deleting %s", e.Name)
+	}
+	return nil
+}
+
+// existingStorage identifies the storage a create of name with options would
+// adopt, the volume it is given and the volumes of the name the driver lists
+func (d *RancherStorageDriver) existingStorage(name string, options map[string]string) ([]string, error) {
+	var result []string
+	if id := options["volumeID"]; id != "" {
+		result = append(result, id)
+	}
+	lister, ok := d.Backend.(Lister)
+	if !ok {
+		return result, nil
+	}
+	vols, err := lister.List(options)
+	if err == ErrNotSupported {
+		return result, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "listing volumes to find %s", name)
+	}
+	for _, vol := range vols {
+		if vol.Name == name {
+			result = append(result, storageID(vol))
+		}
+	}
+	return result, nil
+}
+
+// storageID identifies the storage of vol, by its volumeID unless the driver
+// names its storage after the volume
+func storageID(vol BackendVolume) string {
+	if id := vol.Options["volumeID"]; id != "" {
+		return id
+	}
+	if name := vol.Options["name"]; name != "" {
+		return name
+	}
+	return vol.Name
+}
+
+// undoCreate deletes what a create that did not finish may have left behind,
+// never the storage it adopted. The volume is looked up with the list of the
+// driver when it has one, so its options are known, and is otherwise deleted
+// by name.
+func (d *RancherStorageDriver) undoCreate(e *journalEntry) error {
+	adopted := map[string]bool{}
+	for _, id := range e.Adopted {
+		adopted[id] = true
+	}
+
+	if lister, ok := d.Backend.(Lister); ok {
+		vols, err := lister.List(e.Options)
+		if err != nil && err != ErrNotSupported {
+			return errors.Wrapf(err, "listing volumes to find %s", e.Name)
+		}
+		if err == nil {
+			found, named := false, true
+			for _, vol := range vols {
+				named = named && vol.Name != ""
+				if vol.Name != e.Name {
+					continue
+				}
+				found = true
+				if adopted[storageID(vol)] {
+					logrus.Infof("Create of %s did not finish, keeping the storage %s it adopted", e.Name, storageID(vol))
+					continue
+				}
+				logrus.Warnf("Create of %s did not finish, deleting the storage %s it left behind", e.Name, storageID(vol))
+				if err := d.Backend.Delete(e.Name, Fold(e.Options, vol.Options)); err != nil && err != ErrNotSupported {
+					return errors.Wrapf(err, "deleting %s", e.Name)
+				}
+			}
+			// volumes listed without their name may be the one created
+			if found || named {
+				return nil
+			}
+		}
+	}
+
+	if len(e.Adopted) > 0 {
+		logrus.Infof("Create of %s did not finish, keeping the storage it adopted", e.Name)
+		return nil
+	}
+	logrus.Warnf("Create of %s did not finish, deleting what it left behind", e.Name)
+	if err := d.Backend.Delete(e.Name, e.Options); err != nil && err != ErrNotSupported {
+		return errors.Wrapf(err, "deleting %s", e.Name)
+	}
+	return nil
+}
+
+// replayDelete deletes or archives the volume again with the journaled
+// policy, deletes are idempotent
+func (d *RancherStorageDriver) replayDelete(e *journalEntry) error {
+	policy := e.Policy
+	if policy == "" {
+		var err error
+		if policy, err = d.policy(e.Options); err != nil {
+			return err
+		}
+	}
+	if err := d.reclaim(e.Name, policy, e.Options); err != nil && err != ErrNotSupported {
+		return errors.Wrapf(err, "deleting %s", e.Name)
+	}
+	return d.state.Delete(e.Name)
+}
+
+// replayAttach detaches the device of a mount that did not happen, attaching
+// again returns the device if it is still attached
+func (d *RancherStorageDriver) replayAttach(e *journalEntry) error {
+	if mounted, err := d.isMounted(e.MntDest); err != nil || mounted {
+		return err
+	}
+
+	device, err := d.Backend.Attach(e.Name, e.Options)
+	if err == ErrNotSupported || (err == nil && device == "") {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "finding device of %s", e.Name)
+	}
+
+	logrus.Infof("Detaching %s left attached for %s", device, e.MntDest)
+	if err := d.Backend.Detach(device); err != nil && err != ErrNotSupported {
+		return errors.Wrapf(err, "detach %s", device)
+	}
+	return nil
+}
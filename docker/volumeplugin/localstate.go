@@ -0,0 +1,194 @@
+package volumeplugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/v2"
+)
+
+// LocalState is a StateStore persisted as a JSON file on the host, for
+// running the plugin on Docker hosts that are not managed by Rancher.
+type LocalState struct {
+	driver string
+	hostID string
+	file   string
+	lock   sync.Mutex
+}
+
+// NewLocalState keeps the volumes of driver under basedir, hostID is recorded
+// as the HostId of saved volumes.
+func NewLocalState(driver, basedir, hostID string) (*LocalState, error) {
+	dir := filepath.Join(basedir, state)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating %s", dir)
+	}
+
+	l := &LocalState{
+		driver: driver,
+		hostID: hostID,
+		file:   filepath.Join(dir, driver+".json"),
+	}
+	if _, err := l.load(); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Using local state %s with driver %s", l.file, driver)
+	return l, nil
+}
+
+func (l *LocalState) load() (map[string]client.Volume, error) {
+	vols := map[string]client.Volume{}
+	bytes, err := ioutil.ReadFile(l.file)
+	if os.IsNotExist(err) {
+		return vols, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", l.file)
+	}
+	if err := json.Unmarshal(bytes, &vols); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", l.file)
+	}
+	return vols, nil
+}
+
+func (l *LocalState) store(vols map[string]client.Volume) error {
+	bytes, err := json.MarshalIndent(vols, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes, 0600); err != nil {
+		return errors.Wrapf(err, "writing %s", tmp)
+	}
+	return os.Rename(tmp, l.file)
+}
+
+func (l *LocalState) IsCreated(name string) (bool, error) {
+	_, _, err := l.Get(name)
+	if err == errNoSuchVolume {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *LocalState) Save(name string, options map[string]string, try int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	vols, err := l.load()
+	if err != nil {
+		return err
+	}
+
+	vol, ok := vols[name]
+	if !ok {
+		vol = client.Volume{
+			Name:    name,
+			Driver:  l.driver,
+			Created: time.Now().UTC().Format(time.RFC3339),
+		}
+		vol.Id = name
+	}
+	vol.State = "active"
+	vol.HostId = l.hostID
+	vol.DriverOpts = toMapInterface(options)
+	vols[name] = vol
+
+	logrus.Infof("Saving volume %s %s in %s", name, l.driver, l.file)
+	return l.store(vols)
+}
+
+func (l *LocalState) add(name string, options map[string]string) error {
+	return l.Save(name, options, 0)
+}
+
+func (l *LocalState) Get(name string) (*volume.Volume, *client.Volume, error) {
+	return l.getAny(name)
+}
+
+func (l *LocalState) getAny(name string) (*volume.Volume, *client.Volume, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	vols, err := l.load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vol, ok := vols[name]
+	if !ok {
+		return nil, nil, errNoSuchVolume
+	}
+	return volToVol(vol), &vol, nil
+}
+
+func (l *LocalState) List() ([]*volume.Volume, error) {
+	return l.listAll()
+}
+
+func (l *LocalState) listOptions() (map[string]map[string]string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	vols, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]string{}
+	for name, vol := range vols {
+		result[name] = getOptions(&vol)
+	}
+	return result, nil
+}
+
+func (l *LocalState) ping() error {
+	_, err := l.load()
+	return err
+}
+
+func (l *LocalState) listAll() ([]*volume.Volume, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	vols, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	result := []*volume.Volume{}
+	for _, vol := range vols {
+		result = append(result, volToVol(vol))
+	}
+	return result, nil
+}
+
+// IsRemoving is always true, Docker is the owner of local volumes.
+func (l *LocalState) IsRemoving(vol *client.Volume) bool {
+	return true
+}
+
+func (l *LocalState) Delete(name string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	vols, err := l.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := vols[name]; !ok {
+		return nil
+	}
+	delete(vols, name)
+
+	logrus.Infof("Deleting volume %s %s from %s", name, l.driver, l.file)
+	return l.store(vols)
+}
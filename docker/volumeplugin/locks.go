@@ -0,0 +1,87 @@
+package volumeplugin
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/docker/pkg/locker"
+)
+
+// DefaultMaxConcurrentOps is how many volumes are created, attached, mounted,
+// unmounted or removed at the same time unless configured otherwise.
+const DefaultMaxConcurrentOps = 8
+
+// volumeLocks serializes the operations on a volume and bounds how many
+// volumes are operated on at once, so a backend stuck on one volume does not
+// hold up the others.
+type volumeLocks struct {
+	names   *locker.Locker
+	lock    sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	running int
+}
+
+func newVolumeLocks(limit int) *volumeLocks {
+	l := &volumeLocks{
+		names: locker.New(),
+		limit: limit,
+	}
+	l.cond = sync.NewCond(&l.lock)
+	return l
+}
+
+func (l *volumeLocks) setLimit(limit int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
+
+// acquire locks name and waits for a free slot, the returned function
+// releases both. The volume is locked first so operations queued behind the
+// same volume do not take slots from other volumes.
+func (l *volumeLocks) acquire(name string) func() {
+	l.names.Lock(name)
+
+	l.lock.Lock()
+	for l.limit > 0 && l.running >= l.limit {
+		l.cond.Wait()
+	}
+	l.running++
+	l.lock.Unlock()
+
+	return func() {
+		l.lock.Lock()
+		l.running--
+		l.cond.Signal()
+		l.lock.Unlock()
+
+		l.names.Unlock(name)
+	}
+}
+
+// lockName locks name without taking a slot, for a volume used by the
+// operation on another volume that already holds one
+func (l *volumeLocks) lockName(name string) func() {
+	l.names.Lock(name)
+	return func() {
+		l.names.Unlock(name)
+	}
+}
+
+// SetMaxConcurrentOps bounds how many volumes are operated on at once, 0
+// removes the bound.
+func (d *RancherStorageDriver) SetMaxConcurrentOps(limit int) {
+	d.locks.setLimit(limit)
+}
+
+// lockVolume must be held while the backend is called for a volume
+func (d *RancherStorageDriver) lockVolume(name string) func() {
+	return d.locks.acquire(name)
+}
+
+// lockMount locks the volume mounted on mntDest
+func (d *RancherStorageDriver) lockMount(mntDest string) func() {
+	return d.lockVolume(filepath.Base(mntDest))
+}
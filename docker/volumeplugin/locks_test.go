@@ -0,0 +1,80 @@
+package volumeplugin
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		volumes []string
+		// most operations expected to run at once, overall and by volume
+		want       int
+		wantByName int
+	}{
+		{name: "same volume", limit: 4, volumes: []string{"a", "a", "a"}, want: 1, wantByName: 1},
+		{name: "bounded", limit: 2, volumes: []string{"a", "b", "c", "d"}, want: 2, wantByName: 1},
+		{name: "unbounded", limit: 0, volumes: []string{"a", "b", "c"}, want: 3, wantByName: 1},
+		{name: "queued behind a volume", limit: 2, volumes: []string{"a", "a", "a", "b"}, want: 2, wantByName: 1},
+	}
+
+	for _, test := range tests {
+		l := newVolumeLocks(test.limit)
+		var lock sync.Mutex
+		running, most := 0, 0
+		byName := map[string]int{}
+		mostByName := 0
+
+		var wg sync.WaitGroup
+		for _, name := range test.volumes {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				defer l.acquire(name)()
+
+				lock.Lock()
+				running++
+				byName[name]++
+				if running > most {
+					most = running
+				}
+				if byName[name] > mostByName {
+					mostByName = byName[name]
+				}
+				lock.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+
+				lock.Lock()
+				running--
+				byName[name]--
+				lock.Unlock()
+			}(name)
+		}
+		wg.Wait()
+
+		if most != test.want || mostByName != test.wantByName {
+			t.Errorf("%s: expected %d operations at once and %d by volume, got %d and %d", test.name, test.want, test.wantByName, most, mostByName)
+		}
+	}
+}
+
+func TestLockNameTakesNoSlot(t *testing.T) {
+	l := newVolumeLocks(1)
+	release := l.acquire("copy")
+
+	locked := make(chan struct{})
+	go func() {
+		defer l.lockName("data")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("expected the source of a clone to be locked within the slot of the clone")
+	}
+	release()
+}
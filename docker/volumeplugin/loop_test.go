@@ -0,0 +1,220 @@
+package volumeplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/rancher/storage/docker/volumeplugin/fakerancher"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// The tests run rancher-loop with stubs of the commands it uses to attach and
+// mount, which keep their state in files, and a FakeMounter that follows the
+// mounts of the script.
+var loopStubs = map[string]string{
+	"modprobe":  `exit 0`,
+	"mkfs.ext4": `exit 0`,
+	"blkid":     `echo ext4`,
+	"losetup": `
+loops=$(dirname $0)/loops
+touch ${loops}
+case $1 in
+    -a)
+        cat ${loops}
+        ;;
+    --show)
+        dev=/dev/loop$(wc -l < ${loops})
+        echo "${dev}: [0]:0 ($3)" >> ${loops}
+        echo ${dev}
+        ;;
+    -d)
+        sed -i "\#^$2: #d" ${loops}
+        ;;
+esac`,
+	"mount": `
+echo "$1 $2" >> $(dirname $0)/mounts`,
+	"umount": `
+touch $(dirname $0)/mounts
+sed -i "\# $1\$#d" $(dirname $0)/mounts`,
+	"findmnt": `
+touch $(dirname $0)/mounts
+grep " $2\$" $(dirname $0)/mounts | awk '{print $2 " " $1}'`,
+}
+
+type loopEnv struct {
+	t        *testing.T
+	dir      string
+	imageDir string
+	server   *fakerancher.Server
+	mounter  *mount.FakeMounter
+	backend  *fakeMountBackend
+	path     string
+}
+
+// fakeMountBackend adds the mounts of the script to the FakeMounter of the
+// driver
+type fakeMountBackend struct {
+	*ScriptBackend
+	mounter *mount.FakeMounter
+}
+
+func (b *fakeMountBackend) Mount(mntDest, device, name string, options map[string]string) error {
+	if err := b.ScriptBackend.Mount(mntDest, device, name, options); err != nil {
+		return err
+	}
+	return b.mounter.Mount(device, mntDest, "ext4", nil)
+}
+
+func (b *fakeMountBackend) Unmount(mntDest string) error {
+	if err := b.ScriptBackend.Unmount(mntDest); err != nil {
+		return err
+	}
+	return b.mounter.Unmount(mntDest)
+}
+
+func newLoopEnv(t *testing.T) *loopEnv {
+	script, err := filepath.Abs("../../package/example/rancher-loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "volumeplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &loopEnv{
+		t:        t,
+		dir:      dir,
+		imageDir: filepath.Join(dir, "images"),
+		server:   fakerancher.NewServer(),
+		mounter:  &mount.FakeMounter{},
+		path:     os.Getenv("PATH"),
+	}
+
+	bin := filepath.Join(dir, "bin")
+	for _, d := range []string{bin, e.imageDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stubs := map[string]string{
+		"rancher-loop": "cd " + e.imageDir + " && exec " + script + ` "$@"`,
+	}
+	for name, body := range loopStubs {
+		stubs[name] = body
+	}
+	for name, body := range stubs {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte("#!/bin/bash\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("PATH", bin+":"+e.path)
+
+	e.backend = &fakeMountBackend{
+		ScriptBackend: NewScriptBackend("rancher-loop"),
+		mounter:       e.mounter,
+	}
+	return e
+}
+
+func (e *loopEnv) close() {
+	os.Setenv("PATH", e.path)
+	e.server.Close()
+	os.RemoveAll(e.dir)
+}
+
+func (e *loopEnv) localState() StateStore {
+	state, err := NewLocalState("rancher-loop", e.dir, "host")
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return state
+}
+
+// rancherState registers the driver and the host in the fake Cattle, volumes
+// are added with server.AddVolume before they are created
+func (e *loopEnv) rancherState() (StateStore, string) {
+	driverID := e.server.AddDriver("rancher-loop")
+	e.server.AddHost("host-uuid", "host")
+	client, err := e.server.Client()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	state, err := NewRancherState("rancher-loop", e.server.MetadataURL(), client)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return state, driverID
+}
+
+func (e *loopEnv) driver(state StateStore) *RancherStorageDriver {
+	cli, err := e.server.DockerClient()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	d, err := NewRancherStorageDriverWithMounter("rancher-loop", filepath.Join(e.dir, "volumes"), e.backend, state, cli, e.mounter)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return d
+}
+
+// driverWithoutDocker is the driver of the CSI mode
+func (e *loopEnv) driverWithoutDocker(state StateStore) *RancherStorageDriver {
+	d, err := NewRancherStorageDriverWithMounter("rancher-loop", filepath.Join(e.dir, "volumes"), e.backend, state, nil, e.mounter)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return d
+}
+
+func (e *loopEnv) images() []string {
+	files, err := filepath.Glob(filepath.Join(e.imageDir, "*.img"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return files
+}
+
+// attached returns the loop devices left by the script
+func (e *loopEnv) attached() string {
+	bytes, _ := ioutil.ReadFile(filepath.Join(e.dir, "bin", "loops"))
+	return string(bytes)
+}
+
+func (e *loopEnv) isMounted(d *RancherStorageDriver, name string) bool {
+	mounted, err := d.isMounted(d.getMntDest(name))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return mounted
+}
+
+// runContainer makes Docker list a running container using the volume
+func (e *loopEnv) runContainer(d *RancherStorageDriver, id, name string) {
+	e.server.SetContainers([]types.Container{{
+		ID:    id,
+		State: "running",
+		Mounts: []types.MountPoint{{
+			Source: d.getMntDest(name),
+		}},
+	}})
+	if err := d.syncMounts(); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// expireCallers ends the grace period of the Docker mounts
+func expireCallers(d *RancherStorageDriver) {
+	d.mountMapLock.Lock()
+	defer d.mountMapLock.Unlock()
+	for _, ids := range d.callerMap {
+		for id := range ids {
+			ids[id] = time.Now().Add(-2 * callerGracePeriod)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package volumeplugin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "rancher_storage"
+
+// Volume operations can take minutes on cloud backends, 10ms to ~5m
+var durationBuckets = prometheus.ExponentialBuckets(0.01, 2, 16)
+
+var (
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operations_total",
+		Help:      "Volume operations handled by the plugin.",
+	}, []string{"operation", "result"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of volume operations handled by the plugin.",
+		Buckets:   durationBuckets,
+	}, []string{"operation"})
+
+	execTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "exec_total",
+		Help:      "Invocations of the driver script by subcommand.",
+	}, []string{"command", "result"})
+
+	execDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "exec_duration_seconds",
+		Help:      "Latency of driver script invocations by subcommand.",
+		Buckets:   durationBuckets,
+	}, []string{"command"})
+
+	cattleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "cattle_request_duration_seconds",
+		Help:      "Latency of Cattle API calls.",
+	}, []string{"call", "result"})
+
+	cattleSaveRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cattle_save_retries_total",
+		Help:      "Retries while saving volumes to Cattle.",
+	}, []string{"reason"})
+
+	gcUnmounts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_unmounts_total",
+		Help:      "Mounts removed by the garbage collector.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		operationsTotal,
+		operationDuration,
+		execTotal,
+		execDuration,
+		cattleDuration,
+		cattleSaveRetries,
+		gcUnmounts,
+	)
+}
+
+// ServeMetrics exposes the Prometheus metrics on addr under /metrics.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+func registerMountMetrics(d *RancherStorageDriver) {
+	prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mounts",
+		Help:      "Mount destinations tracked for Docker containers.",
+	}, func() float64 {
+		d.mountMapLock.RLock()
+		defer d.mountMapLock.RUnlock()
+		return float64(len(d.mountMap))
+	}))
+}
+
+func resultLabel(err error) string {
+	if _, ok := err.(*TimeoutError); ok {
+		return "timeout"
+	} else if err == ErrNotSupported {
+		return "not_supported"
+	} else if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// observeOperation is meant to be deferred with the response of the request
+func observeOperation(operation string, start time.Time, errMsg *string) {
+	result := "success"
+	if IsTimeout(*errMsg) {
+		result = "timeout"
+	} else if *errMsg != "" {
+		result = "error"
+	}
+	operationsTotal.WithLabelValues(operation, result).Inc()
+	operationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func observeDetach(start time.Time, err error) {
+	operationsTotal.WithLabelValues("detach", resultLabel(err)).Inc()
+	operationDuration.WithLabelValues("detach").Observe(time.Since(start).Seconds())
+}
+
+func observeExec(command string, start time.Time, err error) {
+	execTotal.WithLabelValues(command, resultLabel(err)).Inc()
+	execDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
+
+func observeCattle(call string, start time.Time, err error) {
+	cattleDuration.WithLabelValues(call, resultLabel(err)).Observe(time.Since(start).Seconds())
+}
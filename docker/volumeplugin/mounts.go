@@ -0,0 +1,233 @@
+package volumeplugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// mountRecord is what is persisted of the mount tracking so it can be
+// reconciled after a restart of the plugin.
+type mountRecord struct {
+	// Mounts maps a mount destination to the containers using it
+	Mounts map[string]map[string]struct{} `json:"mounts"`
+	// Devices maps a mount destination to the device attached for it
+	Devices map[string]string `json:"devices"`
+	// Callers maps a mount destination to the Docker mount IDs using it
+	Callers map[string]map[string]time.Time `json:"callers"`
+}
+
+// callerGracePeriod is how long a Docker mount protects a mount destination
+// from the GC before a container using it has been seen.
+const callerGracePeriod = 5 * time.Minute
+
+// untrackedCaller stands for users of a mount made before Docker mount IDs
+// were tracked. It is never released so only the GC unmounts such mounts.
+const untrackedCaller = ""
+
+func (d *RancherStorageDriver) mountRecordFile() string {
+	return filepath.Join(d.Basedir, state, d.DriverName+"-mounts.json")
+}
+
+func (d *RancherStorageDriver) loadMountRecord() (*mountRecord, error) {
+	record := &mountRecord{
+		Mounts:  map[string]map[string]struct{}{},
+		Devices: map[string]string{},
+		Callers: map[string]map[string]time.Time{},
+	}
+	bytes, err := ioutil.ReadFile(d.mountRecordFile())
+	if os.IsNotExist(err) {
+		return record, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, record); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", d.mountRecordFile())
+	}
+	return record, nil
+}
+
+// saveMountRecord must be called with mountMapLock held
+func (d *RancherStorageDriver) saveMountRecord() {
+	bytes, err := json.Marshal(&mountRecord{
+		Mounts:  d.mountMap,
+		Devices: d.deviceMap,
+		Callers: d.callerMap,
+	})
+	if err != nil {
+		logrus.Errorf("Failed to marshal mounts: %v", err)
+		return
+	}
+
+	file := d.mountRecordFile()
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		logrus.Errorf("Failed to save mounts: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(file+".tmp", bytes, 0600); err != nil {
+		logrus.Errorf("Failed to save mounts: %v", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		logrus.Errorf("Failed to save mounts: %v", err)
+	}
+}
+
+func (d *RancherStorageDriver) addMount(path, id string) {
+	if ids, ok := d.mountMap[path]; ok {
+		ids[id] = struct{}{}
+	} else {
+		d.mountMap[path] = map[string]struct{}{id: {}}
+	}
+}
+
+func (d *RancherStorageDriver) addCaller(path, id string) {
+	if id == untrackedCaller {
+		return
+	}
+
+	d.mountMapLock.Lock()
+	defer d.mountMapLock.Unlock()
+	if _, ok := d.callerMap[path]; !ok {
+		d.callerMap[path] = map[string]time.Time{}
+	}
+	d.callerMap[path][id] = time.Now()
+	d.saveMountRecord()
+}
+
+// removeCaller returns true if id was the last Docker mount of path
+func (d *RancherStorageDriver) removeCaller(path, id string) bool {
+	if id == untrackedCaller {
+		return false
+	}
+
+	d.mountMapLock.Lock()
+	defer d.mountMapLock.Unlock()
+
+	ids, ok := d.callerMap[path]
+	if !ok {
+		return false
+	}
+	if _, ok := ids[id]; !ok {
+		return false
+	}
+	delete(ids, id)
+	d.saveMountRecord()
+	return len(ids) == 0
+}
+
+func (d *RancherStorageDriver) hasRecentCaller(path string) bool {
+	d.mountMapLock.RLock()
+	defer d.mountMapLock.RUnlock()
+	for _, added := range d.callerMap[path] {
+		if time.Since(added) < callerGracePeriod {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileMounts rebuilds the mount tracking from what was persisted before
+// a restart, the containers known to Docker and the mount table. It must run
+// before the first GC so mounts of containers that are still starting are not
+// mistaken for leaks. If Docker can not be reached the persisted mounts are
+// kept, and the GC leaves mounts alone until the containers are synced. It
+// always does without Docker, the callers are then the only users of mounts.
+func (d *RancherStorageDriver) reconcileMounts() error {
+	record, err := d.loadMountRecord()
+	if err != nil {
+		return err
+	}
+
+	mounts, err := d.mounter.List()
+	if err != nil {
+		return errors.Wrap(err, "listing mounts")
+	}
+
+	mntRoot := d.getMntRoot()
+	mounted := map[string]bool{}
+	for _, mount := range mounts {
+		if strings.HasPrefix(mount.Path, mntRoot) {
+			mounted[mount.Path] = true
+		}
+	}
+
+	var containers []types.Container
+	synced := false
+	if d.cli == nil {
+		logrus.Info("Running without Docker, mounts are only released by the callers that made them")
+	} else if containers, err = d.cli.ContainerList(context.Background(), types.ContainerListOptions{All: true}); err != nil {
+		logrus.Errorf("Failed to list containers, keeping the persisted mounts until Docker answers: %v", err)
+	} else {
+		synced = true
+	}
+
+	live := map[string]bool{}
+	for _, container := range containers {
+		if isLiveContainer(container) {
+			live[container.ID] = true
+		}
+	}
+
+	d.mountMapLock.Lock()
+	defer d.mountMapLock.Unlock()
+
+	d.mountsSynced = synced
+	d.mountMap = map[string]map[string]struct{}{}
+	for path, ids := range record.Mounts {
+		for id := range ids {
+			if live[id] || !synced {
+				d.addMount(path, id)
+			}
+		}
+	}
+	for _, container := range containers {
+		if !live[container.ID] {
+			continue
+		}
+		for _, mount := range container.Mounts {
+			if strings.HasPrefix(mount.Source, mntRoot) {
+				d.addMount(mount.Source, container.ID)
+			}
+		}
+	}
+
+	d.callerMap = map[string]map[string]time.Time{}
+	for path := range mounted {
+		if ids, ok := record.Callers[path]; ok {
+			d.callerMap[path] = ids
+		} else {
+			d.callerMap[path] = map[string]time.Time{untrackedCaller: {}}
+		}
+	}
+
+	// devices of destinations that are no longer mounted are detached by the
+	// GC, the driver is not called with the lock held
+	d.deviceMap = map[string]string{}
+	for path, device := range record.Devices {
+		d.deviceMap[path] = device
+	}
+
+	logrus.Infof("Reconciled %d mounts and %d devices", len(d.mountMap), len(d.deviceMap))
+	d.saveMountRecord()
+	return nil
+}
+
+func isLiveContainer(container types.Container) bool {
+	switch container.State {
+	case "exited", "dead":
+		return false
+	case "":
+		// Older API versions only report a human readable status
+		return !strings.HasPrefix(container.Status, "Exited") && container.Status != "Dead"
+	}
+	return true
+}
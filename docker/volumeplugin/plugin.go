@@ -1,8 +1,6 @@
 package volumeplugin
 
 import (
-	"bufio"
-	"encoding/json"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,55 +11,87 @@ import (
 	"k8s.io/kubernetes/pkg/util/mount"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/docker/docker/pkg/locker"
 	dockerClient "github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
-	"github.com/docker/engine-api/types/events"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/pkg/errors"
-	"github.com/rancher/go-rancher/v2"
-	"golang.org/x/net/context"
 )
 
 var errNoSuchVolume = errors.New("No such volume")
 
+var errNotRemoving = errors.New("The volume is kept in Rancher, it is deleted once Rancher removes it")
+
+// IsNoSuchVolume returns true if err, as returned in a volume.Response, means
+// the volume does not exist.
+func IsNoSuchVolume(err string) bool {
+	return err == errNoSuchVolume.Error()
+}
+
+// IsNotRemoving returns true if err, as returned by Delete, means the owner of
+// the state has not removed the volume.
+func IsNotRemoving(err string) bool {
+	return err == errNotRemoving.Error()
+}
+
 const (
 	k8sFsType      = "kubernetes.io/fsType"
 	fsType         = "fs-type"
 	RancherUUID    = "rancher-uuid"
 	DefaultBasedir = "/var/lib/rancher/volumes"
+	// ManagedBasedir is the propagatedMount of the managed plugin
+	ManagedBasedir = "/mnt/volumes"
 	DefaultFsType  = "ext4"
 	DefaultScope   = "flex"
 	state          = "state"
 )
 
-func NewRancherStorageDriver(driver string, client *client.RancherClient, cli *dockerClient.Client) (*RancherStorageDriver, error) {
-	state, err := NewRancherState(driver, client)
-	if err != nil {
-		return nil, err
-	}
+// NewRancherStorageDriver tracks the users of mounts with the containers of
+// Docker, or only with the IDs of the mount requests if cli is nil, as the CSI
+// mode does.
+func NewRancherStorageDriver(driver, basedir string, backend Backend, state StateStore, cli *dockerClient.Client) (*RancherStorageDriver, error) {
+	return NewRancherStorageDriverWithMounter(driver, basedir, backend, state, cli, mount.New())
+}
+
+// NewRancherStorageDriverWithMounter lets tests replace the mount table of the
+// host with a mount.FakeMounter.
+func NewRancherStorageDriverWithMounter(driver, basedir string, backend Backend, state StateStore, cli *dockerClient.Client, mounter mount.Interface) (*RancherStorageDriver, error) {
 	d := &RancherStorageDriver{
 		DriverName:      driver,
-		Basedir:         DefaultBasedir,
+		Basedir:         basedir,
 		Scope:           DefaultScope,
 		CreateSupported: true,
-		Command:         driver,
-		client:          client,
+		Backend:         backend,
 		state:           state,
-		mounter:         &mount.SafeFormatAndMount{Interface: mount.New(), Runner: exec.New()},
-		FsType:          DefaultFsType,
+		mounter:         &mount.SafeFormatAndMount{Interface: mounter, Runner: exec.New()},
 		cli:             cli,
 		SaveOnAttach:    false,
 		mountMap:        map[string]map[string]struct{}{},
-		lock:            locker.New(),
+		deviceMap:       map[string]string{},
+		callerMap:       map[string]map[string]time.Time{},
+		locks:           newVolumeLocks(DefaultMaxConcurrentOps),
+		reclaimPolicy:   ReclaimDelete,
 		Rancher:         rancherDrivers[driver],
 	}
 	if err := d.init(); err != nil {
 		return nil, errors.Wrap(err, "Failed to initialize")
 	}
-	go syncMountMap(d, cli)
+	journal, err := newJournal(d.journalDir())
+	if err != nil {
+		return nil, err
+	}
+	d.journal = journal
+	if err := d.replayJournal(); err != nil {
+		return nil, errors.Wrap(err, "Failed to replay journal")
+	}
+	if err := d.reconcileMounts(); err != nil {
+		return nil, errors.Wrap(err, "Failed to reconcile mounts")
+	}
+	registerMountMetrics(d)
+	if cli != nil {
+		go d.syncMountMap()
+		go d.watchContainerEvents()
+	}
 	d.kickGC()
-	go d.watchContainerEvents()
+	go d.reapTrash()
 	return d, nil
 }
 
@@ -70,37 +100,37 @@ type RancherStorageDriver struct {
 	Basedir         string
 	Scope           string
 	CreateSupported bool
-	Command         string
-	client          *client.RancherClient
-	state           *RancherState
+	Backend         Backend
+	state           StateStore
 	mounter         *mount.SafeFormatAndMount
-	FsType          string
 	cli             *dockerClient.Client
-	mountLock       sync.Mutex
 	SaveOnAttach    bool
 	mountMap        map[string]map[string]struct{}
+	deviceMap       map[string]string
+	callerMap       map[string]map[string]time.Time
 	mountMapLock    sync.RWMutex
-	lock            *locker.Locker
+	mountsSynced    bool
+	locks           *volumeLocks
+	journal         *journal
+	reclaimPolicy   string
+	trashTTL        time.Duration
 	Rancher         bool
+	health          health
 }
 
 func (d *RancherStorageDriver) init() error {
-	_, err := d.exec("init")
-	return err
+	return d.Backend.Init()
 }
 
 func (d *RancherStorageDriver) Create(request volume.Request) volume.Response {
 	// we need to lock the name to make create idempotency
-	if d.Rancher {
-		d.lock.Lock(request.Name)
-		defer d.lock.Unlock(request.Name)
-	}
+	defer d.lockVolume(request.Name)()
 
 	logRequest("create", &request)
 
 	response := volume.Response{}
-	output := &CmdOutput{}
-	defer logResponse("create", request.Name, &response, output)
+	defer logResponse("create", request.Name, &response)
+	defer observeOperation("create", time.Now(), &response.Err)
 
 	if created, err := d.state.IsCreated(request.Name); err != nil {
 		response.Err = err.Error()
@@ -109,23 +139,70 @@ func (d *RancherStorageDriver) Create(request volume.Request) volume.Response {
 		return response
 	}
 
+	if policy := request.Options[reclaimPolicyOption]; policy != "" {
+		if err := validReclaimPolicy(policy); err != nil {
+			response.Err = err.Error()
+			return response
+		}
+	}
+
+	adopted, err := d.existingStorage(request.Name, request.Options)
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+	entry := &journalEntry{
+		Op:      journalCreate,
+		Name:    request.Name,
+		Options: request.Options,
+		Adopted: adopted,
+	}
+	if err := d.journal.begin(entry); err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
 	result := request.Options
-	if d.CreateSupported {
-		var err error
-		*output, err = d.exec("create", toArgs(request.Name, request.Options))
+	if source := request.Options[cloneFromOption]; source != "" {
+		options, err := d.clone(request.Name, request.Options, source)
 		if err != nil {
+			d.journal.abort(entry, err)
 			response.Err = err.Error()
 			return response
 		}
-		result = fold(result, output.Options)
+		result = Fold(result, options, ownership(options))
+	} else {
+		if fs := d.getFsType(result); fs != "" {
+			result = Fold(result, map[string]string{fsType: fs})
+		}
+		if d.CreateSupported {
+			options, err := d.Backend.Create(request.Name, result)
+			if err != nil {
+				d.journal.abort(entry, err)
+				response.Err = err.Error()
+				return response
+			}
+			result = Fold(result, options, ownership(options))
+		}
+	}
+
+	entry.Options = result
+	entry.Done = true
+	if err := d.journal.update(entry); err != nil {
+		logrus.Errorf("Failed to journal create of %s: %v", request.Name, err)
 	}
 
 	if err := d.state.Save(request.Name, result, 0); err != nil {
 		logrus.Errorf("Save volume name=%s failed, err: %s", request.Name, err)
-		d.exec("delete", toArgs(request.Name, result))
+		if err := d.Backend.Delete(request.Name, result); err != nil && err != ErrNotSupported {
+			logrus.Errorf("Failed to delete %s after failing to save it, retrying on the next start: %v", request.Name, err)
+		} else {
+			d.journal.finish(entry)
+		}
 		response.Err = err.Error()
 		return response
 	}
+	d.journal.finish(entry)
 
 	return response
 }
@@ -157,11 +234,13 @@ func (d *RancherStorageDriver) Get(request volume.Request) volume.Response {
 }
 
 func (d *RancherStorageDriver) Remove(request volume.Request) volume.Response {
+	defer d.lockVolume(request.Name)()
+
 	logRequest("remove", &request)
 
 	response := volume.Response{}
-	output := &CmdOutput{}
-	defer logResponse("remove", request.Name, &response, output)
+	defer logResponse("remove", request.Name, &response)
+	defer observeOperation("remove", time.Now(), &response.Err)
 
 	_, rVol, err := d.state.Get(request.Name)
 	if err == errNoSuchVolume {
@@ -172,18 +251,78 @@ func (d *RancherStorageDriver) Remove(request volume.Request) volume.Response {
 	}
 
 	// Docker removal is fake, unless Rancher initiated removal of resource, then we do it.
-	if rVol.State == "removing" {
-		var err error
-		*output, err = d.exec("delete", toArgs(request.Name, getOptions(rVol)))
+	if d.state.IsRemoving(rVol) {
+		options := getOptions(rVol)
+		policy, err := d.policy(options)
 		if err != nil {
 			response.Err = err.Error()
 			return response
 		}
+		if policy == ReclaimRetain {
+			logrus.Infof("Retaining the storage of %s", request.Name)
+			if err := d.state.Delete(request.Name); err != nil {
+				response.Err = err.Error()
+			}
+			return response
+		}
+
+		if d.trashTTL > 0 {
+			err := d.trashVolume(request.Name, policy, rVol, options)
+			if err == nil {
+				if err := d.state.Delete(request.Name); err != nil {
+					response.Err = err.Error()
+				}
+				return response
+			} else if err != ErrNotSupported {
+				response.Err = err.Error()
+				return response
+			}
+			logrus.Warnf("%s does not support trash, reclaiming %s now", d.DriverName, request.Name)
+		}
+
+		// the policy is journaled, the default may change before a replay
+		entry := &journalEntry{
+			Op:      journalDelete,
+			Name:    request.Name,
+			Options: options,
+			Policy:  policy,
+		}
+		if err := d.journal.begin(entry); err != nil {
+			response.Err = err.Error()
+			return response
+		}
+		if err := d.reclaim(request.Name, policy, options); err != nil {
+			d.journal.finish(entry)
+			response.Err = err.Error()
+			return response
+		}
+		// the volume is gone, a failure to forget it is retried on the next start
+		if err := d.state.Delete(request.Name); err != nil {
+			response.Err = err.Error()
+			return response
+		}
+		d.journal.finish(entry)
 	}
 
 	return response
 }
 
+// Delete removes a volume for an owner other than Docker, the CSI controller.
+// Unlike a Docker remove it fails while the owner of the state keeps the
+// volume.
+func (d *RancherStorageDriver) Delete(request volume.Request) volume.Response {
+	_, rVol, err := d.state.getAny(request.Name)
+	if err == errNoSuchVolume {
+		return volume.Response{}
+	} else if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	if !d.state.IsRemoving(rVol) {
+		return volume.Response{Err: errNotRemoving.Error()}
+	}
+	return d.Remove(request)
+}
+
 func (d *RancherStorageDriver) isMounted(path string) (bool, error) {
 	mounts, err := d.mounter.List()
 	if err != nil {
@@ -198,27 +337,51 @@ func (d *RancherStorageDriver) isMounted(path string) (bool, error) {
 	return false, nil
 }
 
-func (d *RancherStorageDriver) doAttach(name, opts string) (*CmdOutput, error) {
-	cmdOutput, err := d.exec("attach", opts)
-	if err != nil && err != errNotSupported {
-		logrus.Errorf("Failed to attach, opts==%s: %v", opts, err)
-		return nil, err
+// isMountedReadWrite tells whether path is mounted on this host without the
+// ro option
+func (d *RancherStorageDriver) isMountedReadWrite(path string) (bool, error) {
+	mounts, err := d.mounter.List()
+	if err != nil {
+		return false, err
 	}
+	for _, mount := range mounts {
+		if mount.Path != path {
+			continue
+		}
+		readOnly := false
+		for _, opt := range mount.Opts {
+			if opt == "ro" {
+				readOnly = true
+			}
+		}
+		if !readOnly {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
 
-	return &cmdOutput, nil
+func (d *RancherStorageDriver) doAttach(name string, opts map[string]string) (string, error) {
+	device, err := d.Backend.Attach(name, opts)
+	if err != nil && err != ErrNotSupported {
+		logrus.Errorf("Failed to attach %s, opts==%v: %v", name, opts, err)
+		return "", err
+	}
+
+	return device, nil
 }
 
 func (d *RancherStorageDriver) Attach(request AttachRequest) volume.Response {
-	d.mountLock.Lock()
-	defer d.mountLock.Unlock()
+	defer d.lockVolume(request.Name)()
 
 	logrus.WithFields(logrus.Fields{
 		"name": request.Name,
 	}).Info("attach.request")
 
 	response := volume.Response{}
-	output := &CmdOutput{}
-	defer logResponse("attach", request.Name, &response, output)
+	defer logResponse("attach", request.Name, &response)
+	defer observeOperation("attach", time.Now(), &response.Err)
 
 	_, rVol, err := d.state.Get(request.Name)
 	if err != nil {
@@ -226,8 +389,7 @@ func (d *RancherStorageDriver) Attach(request AttachRequest) volume.Response {
 		return response
 	}
 
-	opts := toArgs(request.Name, getOptions(rVol))
-	output, err = d.doAttach(request.Name, opts)
+	device, err := d.doAttach(request.Name, getOptions(rVol))
 	if err != nil {
 		response.Err = err.Error()
 		return response
@@ -236,7 +398,7 @@ func (d *RancherStorageDriver) Attach(request AttachRequest) volume.Response {
 	// If SaveOnAttach, update driver Options.
 	if d.SaveOnAttach {
 		options := getOptions(rVol)
-		options["device"] = output.Device
+		options["device"] = device
 		if err := d.state.Save(request.Name, options, 0); err != nil {
 			logrus.Errorf("Save volume name=%s failed, err: %s", request.Name, err)
 			response.Err = err.Error()
@@ -248,16 +410,15 @@ func (d *RancherStorageDriver) Attach(request AttachRequest) volume.Response {
 }
 
 func (d *RancherStorageDriver) Mount(request volume.MountRequest) volume.Response {
-	d.mountLock.Lock()
-	defer d.mountLock.Unlock()
+	defer d.lockVolume(request.Name)()
 
 	logrus.WithFields(logrus.Fields{
 		"name": request.Name,
 	}).Info("mount.request")
 
 	response := volume.Response{}
-	output := &CmdOutput{}
-	defer logResponse("mount", request.Name, &response, output)
+	defer logResponse("mount", request.Name, &response)
+	defer observeOperation("mount", time.Now(), &response.Err)
 
 	_, rVol, err := d.state.Get(request.Name)
 	if err != nil {
@@ -271,37 +432,63 @@ func (d *RancherStorageDriver) Mount(request volume.MountRequest) volume.Respons
 		return response
 	} else if mounted {
 		logrus.Infof("%s already mounted on %s", request.Name, mntDest)
+		d.addCaller(mntDest, request.ID)
 		response.Mountpoint = mntDest
 		return response
 	}
 
-	opts := toArgs(request.Name, getOptions(rVol))
-	output, err = d.doAttach(request.Name, opts)
-	if err != nil && err != errNotSupported {
+	opts := getOptions(rVol)
+	if fs := d.getFsType(opts); fs != "" {
+		opts[fsType] = fs
+	}
+	entry := &journalEntry{
+		Op:      journalAttach,
+		Name:    request.Name,
+		Options: opts,
+		MntDest: mntDest,
+	}
+	if err := d.journal.begin(entry); err != nil {
+		response.Err = err.Error()
+		return response
+	}
+	device, err := d.doAttach(request.Name, opts)
+	if err != nil {
+		d.journal.abort(entry, err)
 		logrus.Errorf("Failed to attach %s: %v", request.Name, err)
 		response.Err = err.Error()
 		return response
 	}
 
 	os.MkdirAll(mntDest, 0750)
-	*output, err = d.exec("mount", mntDest, output.Device, opts)
-	if err != nil {
+	if device != "" {
+		d.mountMapLock.Lock()
+		d.deviceMap[mntDest] = device
+		d.saveMountRecord()
+		d.mountMapLock.Unlock()
+	}
+	// the device is tracked with the mount from here on
+	d.journal.finish(entry)
+
+	if err := d.Backend.Mount(mntDest, device, request.Name, opts); err != nil {
 		logrus.Errorf("Failed to mount %s: %v", request.Name, err)
 		response.Err = err.Error()
+		// the GC detaches the device unless Docker retries the mount first
+		d.kickGC()
 		return response
 	}
+	d.addCaller(mntDest, request.ID)
 
 	response.Mountpoint = mntDest
 	return response
 }
 
-func (d *RancherStorageDriver) getFsType(vol *client.Volume) string {
-	fsType, _ := vol.DriverOpts[fsType].(string)
+// getFsType returns the filesystem requested in the volume options, if any.
+// Drivers format new volumes with DefaultFsType and mount existing ones with
+// whatever filesystem they have when none is requested.
+func (d *RancherStorageDriver) getFsType(options map[string]string) string {
+	fsType := options[fsType]
 	if fsType == "" {
-		fsType, _ = vol.DriverOpts[k8sFsType].(string)
-	}
-	if fsType == "" {
-		fsType = d.FsType
+		fsType = options[k8sFsType]
 	}
 	return fsType
 }
@@ -312,23 +499,48 @@ func (d *RancherStorageDriver) Unmount(request volume.UnmountRequest) volume.Res
 	}).Info("unmount.request")
 
 	response := volume.Response{}
-	defer logResponse("unmount", request.Name, &response, &CmdOutput{})
+	defer logResponse("unmount", request.Name, &response)
+	defer observeOperation("unmount", time.Now(), &response.Err)
+
+	defer d.lockVolume(request.Name)()
+
+	// Docker tells us which mount is released, once the last one is gone
+	// unmount now rather than waiting for the GC to notice.
+	mntDest := d.getMntDest(request.Name)
+	if d.removeCaller(mntDest, request.ID) {
+		if err := d.doUnmount(mntDest); err != nil {
+			logrus.Errorf("Failed to unmount %s: %v", mntDest, err)
+			response.Err = err.Error()
+			d.kickGC()
+		}
+		return response
+	}
 
 	d.kickGC()
 	return response
 }
 
-func (d *RancherStorageDriver) unmount(mntDest string) error {
-	d.mountLock.Lock()
-	defer d.mountLock.Unlock()
+// unmount is used by the GC, it skips mounts that Docker has just asked for.
+func (d *RancherStorageDriver) unmount(mntDest string) (bool, error) {
+	defer d.lockMount(mntDest)()
 
+	if d.hasRecentCaller(mntDest) {
+		logrus.Infof("Skipping unmount of %s, recently mounted by Docker", mntDest)
+		return false, nil
+	}
+
+	return true, d.doUnmount(mntDest)
+}
+
+// doUnmount must be called with the volume locked
+func (d *RancherStorageDriver) doUnmount(mntDest string) error {
 	logrus.Infof("Unmounting %s", mntDest)
 	device, refCount, err := mount.GetDeviceNameFromMount(d.mounter, mntDest)
 	if err != nil {
 		return errors.Wrapf(err, "find device %s", mntDest)
 	}
 
-	if _, err := d.exec("unmount", mntDest); err == errNotSupported {
+	if err := d.Backend.Unmount(mntDest); err == ErrNotSupported {
 		if err := d.mounter.Unmount(mntDest); err != nil {
 			return errors.Wrapf(err, "umount with mounter %s", mntDest)
 		}
@@ -337,13 +549,20 @@ func (d *RancherStorageDriver) unmount(mntDest string) error {
 	}
 
 	if refCount != 1 {
+		d.forgetMount(mntDest)
 		return nil
 	}
 
 	logrus.Infof("Detaching %s", device)
-	if _, err := d.exec("detach", device); err != nil && err != errNotSupported {
+	start := time.Now()
+	if err = d.Backend.Detach(device); err == ErrNotSupported {
+		err = nil
+	}
+	observeDetach(start, err)
+	if err != nil {
 		return errors.Wrapf(err, "detach %s", device)
 	}
+	d.forgetMount(mntDest)
 
 	if _, err := os.Stat(mntDest); err == nil {
 		if notmnt, err := d.mounter.IsLikelyNotMountPoint(mntDest); err != nil {
@@ -359,6 +578,52 @@ func (d *RancherStorageDriver) unmount(mntDest string) error {
 	return nil
 }
 
+// detachUnmounted detaches the device recorded for mntDest if the volume was
+// not mounted after all, and no other mount uses the device.
+func (d *RancherStorageDriver) detachUnmounted(mntDest string) error {
+	defer d.lockMount(mntDest)()
+
+	if mounted, err := d.isMounted(mntDest); err != nil || mounted {
+		return err
+	}
+
+	d.mountMapLock.RLock()
+	device, ok := d.deviceMap[mntDest]
+	inUse := false
+	for path, other := range d.deviceMap {
+		if path != mntDest && other == device {
+			inUse = true
+		}
+	}
+	d.mountMapLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	if !inUse {
+		logrus.Infof("Detaching %s left attached for %s", device, mntDest)
+		start := time.Now()
+		err := d.Backend.Detach(device)
+		if err == ErrNotSupported {
+			err = nil
+		}
+		observeDetach(start, err)
+		if err != nil {
+			return errors.Wrapf(err, "detach %s", device)
+		}
+	}
+	d.forgetMount(mntDest)
+	return nil
+}
+
+func (d *RancherStorageDriver) forgetMount(mntDest string) {
+	d.mountMapLock.Lock()
+	defer d.mountMapLock.Unlock()
+	delete(d.deviceMap, mntDest)
+	delete(d.callerMap, mntDest)
+	d.saveMountRecord()
+}
+
 func (d *RancherStorageDriver) Path(request volume.Request) volume.Response {
 	return volume.Response{
 		Mountpoint: d.getMntDest(request.Name),
@@ -405,11 +670,34 @@ func (d *RancherStorageDriver) gc() error {
 		}
 	}
 
+	// Devices attached for mounts that failed or timed out
+	toDetach := map[string]bool{}
+	d.mountMapLock.RLock()
+	for path := range d.deviceMap {
+		if !toCheck[path] {
+			toDetach[path] = true
+		}
+	}
+	d.mountMapLock.RUnlock()
+
+	var lastErr error
+	for mnt := range toDetach {
+		if err := d.detachUnmounted(mnt); err != nil {
+			lastErr = err
+			logrus.Errorf("Failed to detach device of %s: %v", mnt, err)
+		}
+	}
+
 	if len(toCheck) == 0 {
-		return nil
+		return lastErr
 	}
 
 	d.mountMapLock.RLock()
+	if !d.mountsSynced {
+		d.mountMapLock.RUnlock()
+		logrus.Info("Skipping unmounts until the containers are listed")
+		return lastErr
+	}
 	for src, ids := range d.mountMap {
 		if len(ids) == 0 {
 			if toCheck[src] {
@@ -425,11 +713,12 @@ func (d *RancherStorageDriver) gc() error {
 	}
 	d.mountMapLock.RUnlock()
 
-	var lastErr error
 	for mnt := range toUnmount {
-		if err := d.unmount(mnt); err != nil {
+		if unmounted, err := d.unmount(mnt); err != nil {
 			lastErr = err
 			logrus.Errorf("Failed to unmount %s: %v", mnt, err)
+		} else if unmounted {
+			gcUnmounts.Inc()
 		}
 	}
 
@@ -437,90 +726,5 @@ func (d *RancherStorageDriver) gc() error {
 }
 
 func (d *RancherStorageDriver) ListAllVolumes() ([]*volume.Volume, error) {
-	vols, err := d.state.client.Volume.List(&client.ListOpts{
-		Filters: map[string]interface{}{
-			"removed_null":    "true",
-			"limit":           "-1",
-			"storageDriverId": d.state.driverID,
-		},
-	})
-	if err != nil {
-		return nil, err
-	}
-	result := []*volume.Volume{}
-	for _, vol := range vols.Data {
-		result = append(result, volToVol(vol))
-	}
-	return result, nil
-}
-
-func (d *RancherStorageDriver) watchContainerEvents() error {
-	for {
-		reader, err := d.cli.Events(context.Background(), types.EventsOptions{})
-		if err != nil {
-			logrus.Error(err)
-			continue
-		}
-		defer reader.Close()
-
-		scanner := bufio.NewScanner(reader)
-		for scanner.Scan() {
-			var event events.Message
-			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
-				logrus.Errorf("Failed to unmarshal %s: %v", scanner.Text(), err)
-			}
-			if event.Status == "destroy" {
-				logrus.Infof("container %s destroyed", event.ID)
-				d.mountMapLock.Lock()
-				for _, mountsMap := range d.mountMap {
-					delete(mountsMap, event.ID)
-				}
-				d.mountMapLock.Unlock()
-				d.kickGC()
-			} else if event.Status == "start" {
-				inspect, err := d.cli.ContainerInspect(context.Background(), event.ID)
-				if err != nil {
-					logrus.Errorf("failed to inspect new created container, err: %v", err)
-					continue
-				}
-				d.mountMapLock.Lock()
-				for _, mount := range inspect.Mounts {
-					if strings.HasPrefix(mount.Source, d.getMntRoot()) {
-						if ids, ok := d.mountMap[mount.Source]; ok {
-							ids[event.ID] = struct{}{}
-						} else {
-							d.mountMap[mount.Source] = map[string]struct{}{}
-							d.mountMap[mount.Source][event.ID] = struct{}{}
-						}
-					}
-				}
-				d.mountMapLock.Unlock()
-			}
-		}
-		time.Sleep(2 * time.Second)
-	}
-}
-
-func syncMountMap(d *RancherStorageDriver, cli *dockerClient.Client) {
-	for {
-		containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
-		if err != nil {
-			continue
-		}
-		d.mountMapLock.Lock()
-		for _, container := range containers {
-			for _, mount := range container.Mounts {
-				if strings.HasPrefix(mount.Source, d.getMntRoot()) {
-					if ids, ok := d.mountMap[mount.Source]; ok {
-						ids[container.ID] = struct{}{}
-					} else {
-						d.mountMap[mount.Source] = map[string]struct{}{}
-						d.mountMap[mount.Source][container.ID] = struct{}{}
-					}
-				}
-			}
-		}
-		d.mountMapLock.Unlock()
-		time.Sleep(time.Minute * 1)
-	}
+	return d.state.listAll()
 }
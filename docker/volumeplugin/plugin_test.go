@@ -0,0 +1,361 @@
+package volumeplugin
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestCreateMountUnmountRemove(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	d := e.driver(e.localState())
+
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); r.Err != "" {
+		t.Fatalf("create: %s", r.Err)
+	}
+	if images := e.images(); len(images) != 1 {
+		t.Fatalf("expected one image after create, got %v", images)
+	}
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); r.Err != "" {
+		t.Fatalf("create again: %s", r.Err)
+	}
+	if images := e.images(); len(images) != 1 {
+		t.Fatalf("expected create to be idempotent, got %v", images)
+	}
+
+	r := d.Mount(volume.MountRequest{Name: "data", ID: "m1"})
+	if r.Err != "" {
+		t.Fatalf("mount: %s", r.Err)
+	}
+	if r.Mountpoint != d.getMntDest("data") || !e.isMounted(d, "data") {
+		t.Fatalf("expected data to be mounted on %s, got %s", d.getMntDest("data"), r.Mountpoint)
+	}
+	if !strings.Contains(e.attached(), "/dev/loop0") {
+		t.Fatalf("expected data to be attached, got %q", e.attached())
+	}
+
+	// a second mount of the volume is released first
+	if r := d.Mount(volume.MountRequest{Name: "data", ID: "m2"}); r.Err != "" {
+		t.Fatalf("mount again: %s", r.Err)
+	}
+	if r := d.Unmount(volume.UnmountRequest{Name: "data", ID: "m2"}); r.Err != "" {
+		t.Fatalf("unmount m2: %s", r.Err)
+	}
+	if !e.isMounted(d, "data") {
+		t.Fatal("expected data to stay mounted for m1")
+	}
+
+	if r := d.Unmount(volume.UnmountRequest{Name: "data", ID: "m1"}); r.Err != "" {
+		t.Fatalf("unmount m1: %s", r.Err)
+	}
+	if e.isMounted(d, "data") {
+		t.Fatal("expected data to be unmounted after the last unmount")
+	}
+	if e.attached() != "" {
+		t.Fatalf("expected data to be detached, got %q", e.attached())
+	}
+
+	if r := d.Remove(volume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("remove: %s", r.Err)
+	}
+	if images := e.images(); len(images) != 0 {
+		t.Fatalf("expected no image after remove, got %v", images)
+	}
+	if r := d.Get(volume.Request{Name: "data"}); !IsNoSuchVolume(r.Err) {
+		t.Fatalf("expected data to be gone, got %q", r.Err)
+	}
+}
+
+func TestGCUnmountsMountsWithoutContainers(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	d := e.driver(e.localState())
+
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); r.Err != "" {
+		t.Fatalf("create: %s", r.Err)
+	}
+	if r := d.Mount(volume.MountRequest{Name: "data", ID: "m1"}); r.Err != "" {
+		t.Fatalf("mount: %s", r.Err)
+	}
+
+	// Docker mounted the volume recently, its container may still be starting
+	if err := d.gc(); err != nil {
+		t.Fatal(err)
+	}
+	if !e.isMounted(d, "data") {
+		t.Fatal("expected the GC to keep a recent mount")
+	}
+
+	e.runContainer(d, "c1", "data")
+	expireCallers(d)
+	if err := d.gc(); err != nil {
+		t.Fatal(err)
+	}
+	if !e.isMounted(d, "data") {
+		t.Fatal("expected the GC to keep the mount of a running container")
+	}
+
+	e.server.SetContainers(nil)
+	if err := d.syncMounts(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.gc(); err != nil {
+		t.Fatal(err)
+	}
+	if e.isMounted(d, "data") {
+		t.Fatal("expected the GC to unmount once the container is gone")
+	}
+	if e.attached() != "" {
+		t.Fatalf("expected the GC to detach, got %q", e.attached())
+	}
+}
+
+func TestRemoveWithRancherState(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	state, driverID := e.rancherState()
+	d := e.driver(state)
+
+	e.server.AddVolume("data", "rancher-loop", driverID, "requested")
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); r.Err != "" {
+		t.Fatalf("create: %s", r.Err)
+	}
+	vol := e.server.Volume("data")
+	if vol == nil || vol.DriverOpts["volumeID"] == nil {
+		t.Fatalf("expected the options of data to be saved in Cattle, got %+v", vol)
+	}
+
+	// Docker removes volumes that are still used on other hosts
+	if r := d.Remove(volume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("remove: %s", r.Err)
+	}
+	if images := e.images(); len(images) != 1 {
+		t.Fatalf("expected the image to be kept until Rancher removes data, got %v", images)
+	}
+
+	if err := e.server.SetVolumeState("data", "removing"); err != nil {
+		t.Fatal(err)
+	}
+	if r := d.Remove(volume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("remove: %s", r.Err)
+	}
+	if images := e.images(); len(images) != 0 {
+		t.Fatalf("expected the image to be deleted, got %v", images)
+	}
+}
+
+func TestMountsWithoutDocker(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	d := e.driverWithoutDocker(e.localState())
+
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); r.Err != "" {
+		t.Fatalf("create: %s", r.Err)
+	}
+	staging := "/var/lib/kubelet/plugins/staging/data"
+	if r := d.Mount(volume.MountRequest{Name: "data", ID: staging}); r.Err != "" {
+		t.Fatalf("mount: %s", r.Err)
+	}
+
+	// no container ever uses the mount, the staging path does
+	expireCallers(d)
+	if err := d.gc(); err != nil {
+		t.Fatal(err)
+	}
+	if !e.isMounted(d, "data") {
+		t.Fatal("expected the GC to keep a staged mount")
+	}
+
+	if r := d.Unmount(volume.UnmountRequest{Name: "data", ID: staging}); r.Err != "" {
+		t.Fatalf("unmount: %s", r.Err)
+	}
+	if e.isMounted(d, "data") {
+		t.Fatal("expected data to be unmounted when it is unstaged")
+	}
+	if e.attached() != "" {
+		t.Fatalf("expected data to be detached when it is unstaged, got %q", e.attached())
+	}
+}
+
+func TestDeleteKeptByRancher(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	state, driverID := e.rancherState()
+	d := e.driverWithoutDocker(state)
+
+	e.server.AddVolume("data", "rancher-loop", driverID, "requested")
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); r.Err != "" {
+		t.Fatalf("create: %s", r.Err)
+	}
+
+	if r := d.Delete(volume.Request{Name: "data"}); !IsNotRemoving(r.Err) {
+		t.Fatalf("expected delete to fail while Rancher keeps data, got %q", r.Err)
+	}
+	if images := e.images(); len(images) != 1 {
+		t.Fatalf("expected the image to be kept, got %v", images)
+	}
+
+	if err := e.server.SetVolumeState("data", "removing"); err != nil {
+		t.Fatal(err)
+	}
+	if r := d.Delete(volume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("delete: %s", r.Err)
+	}
+	if images := e.images(); len(images) != 0 {
+		t.Fatalf("expected the image to be deleted, got %v", images)
+	}
+}
+
+func TestCreateJournal(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	state := e.localState()
+	d := e.driver(state)
+
+	// the driver reports the failure, nothing is left to undo
+	if r := d.Create(volume.Request{Name: "nosize"}); r.Err == "" {
+		t.Fatal("expected create without a size to fail")
+	}
+	if entries, _ := d.journal.entries(); len(entries) != 0 {
+		t.Fatalf("expected a failed create to be forgotten, got %+v", entries[0])
+	}
+
+	// storage retained with the name of the volume is adopted by the create
+	retain := map[string]string{"size": "1", reclaimPolicyOption: ReclaimRetain}
+	if r := d.Create(volume.Request{Name: "data", Options: retain}); r.Err != "" {
+		t.Fatalf("create: %s", r.Err)
+	}
+	if r := d.Remove(volume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("remove: %s", r.Err)
+	}
+	retained := e.images()
+	if len(retained) != 1 {
+		t.Fatalf("expected the image of data to be retained, got %v", retained)
+	}
+
+	// a create that times out may still provision the volume
+	if err := ioutil.WriteFile(filepath.Join(e.dir, "bin", "mkfs.ext4"), []byte("#!/bin/bash\nsleep 5\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	e.backend.Timeouts["create"] = 200 * time.Millisecond
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); !IsTimeout(r.Err) {
+		t.Fatalf("expected create to time out, got %q", r.Err)
+	}
+	entries, err := d.journal.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "data" || entries[0].Done || len(entries[0].Adopted) != 1 {
+		t.Fatalf("expected the unfinished create of data to be journaled, got %+v", entries)
+	}
+	if images := e.images(); len(images) != 2 {
+		t.Fatalf("expected the create to leave an image behind, got %v", images)
+	}
+
+	// the next start undoes the create and keeps what it adopted
+	delete(e.backend.Timeouts, "create")
+	d = e.driver(state)
+	if entries, _ := d.journal.entries(); len(entries) != 0 {
+		t.Fatalf("expected the create to be undone on start, got %+v", entries[0])
+	}
+	if images := e.images(); len(images) != 1 || images[0] != retained[0] {
+		t.Fatalf("expected only the retained image %v to be left, got %v", retained, images)
+	}
+}
+
+func TestTrashIsSharedByHosts(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	d := e.driver(e.localState())
+	d.SetTrashTTL(time.Hour)
+
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); r.Err != "" {
+		t.Fatalf("create: %s", r.Err)
+	}
+	if r := d.Remove(volume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("remove: %s", r.Err)
+	}
+
+	// another host with its own state finds the trash through the driver
+	otherState, err := NewLocalState("rancher-loop", filepath.Join(e.dir, "other"), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := e.driver(otherState)
+	r := other.ListTrash(UndeleteRequest{})
+	if r.Err != "" || len(r.Trash) != 1 || r.Trash[0].Name != "data" || r.Trash[0].Policy != ReclaimDelete {
+		t.Fatalf("expected data in the trash, got %+v", r)
+	}
+	id := r.Trash[0].ID
+
+	if r := other.Undelete(UndeleteRequest{Name: "data"}); r.Err != "" {
+		t.Fatalf("undelete: %s", r.Err)
+	}
+	if r := other.Get(volume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("expected data to be restored, got %q", r.Err)
+	}
+	if r := d.ListTrash(UndeleteRequest{}); len(r.Trash) != 0 {
+		t.Fatalf("expected the trash to be empty, got %+v", r.Trash)
+	}
+
+	// the volume is trashed to the same place when it is removed again
+	other.SetTrashTTL(time.Hour)
+	if r := other.Remove(volume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("remove: %s", r.Err)
+	}
+	entries, err := d.trashEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected data in the trash, got %+v", entries)
+	}
+	if entries[0].ID == id {
+		t.Fatalf("expected the restored volume to be trashed as a new volume, got %s again", id)
+	}
+
+	d.reap(entries[0], time.Now())
+	if images := e.images(); len(images) != 1 {
+		t.Fatalf("expected the trash to be kept until it expires, got %v", images)
+	}
+	d.reap(entries[0], entries[0].Expires)
+	if images := e.images(); len(images) != 0 {
+		t.Fatalf("expected the trash to be reaped, got %v", images)
+	}
+}
+
+func TestCloneRefusesMountedSource(t *testing.T) {
+	e := newLoopEnv(t)
+	defer e.close()
+	d := e.driver(e.localState())
+
+	if r := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); r.Err != "" {
+		t.Fatalf("create: %s", r.Err)
+	}
+	if r := d.Mount(volume.MountRequest{Name: "data", ID: "m1"}); r.Err != "" {
+		t.Fatalf("mount: %s", r.Err)
+	}
+
+	clone := volume.Request{Name: "copy", Options: map[string]string{cloneFromOption: "data"}}
+	if r := d.Create(clone); !strings.Contains(r.Err, "mounted read-write") {
+		t.Fatalf("expected the clone of a mounted volume to fail, got %q", r.Err)
+	}
+	if images := e.images(); len(images) != 1 {
+		t.Fatalf("expected no copy, got %v", images)
+	}
+
+	if r := d.Unmount(volume.UnmountRequest{Name: "data", ID: "m1"}); r.Err != "" {
+		t.Fatalf("unmount: %s", r.Err)
+	}
+	if r := d.Create(clone); r.Err != "" {
+		t.Fatalf("clone: %s", r.Err)
+	}
+	if images := e.images(); len(images) != 2 {
+		t.Fatalf("expected a copy, got %v", images)
+	}
+}
@@ -13,8 +13,8 @@ import (
 )
 
 const (
-	metadataURL = "http://169.254.169.250/2015-12-19"
-	detached    = "detached"
+	DefaultMetadataURL = "http://169.254.169.250/2015-12-19"
+	detached           = "detached"
 )
 
 var goodStates = map[string]bool{
@@ -42,8 +42,8 @@ type RancherState struct {
 	driverID string
 }
 
-func NewRancherState(driver string, client *client.RancherClient) (*RancherState, error) {
-	host, err := getHostID(client)
+func NewRancherState(driver, metadataURL string, client *client.RancherClient) (*RancherState, error) {
+	host, err := getHostID(metadataURL, client)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting host ID")
 	}
@@ -84,6 +84,7 @@ func (r *RancherState) Save(name string, options map[string]string, try int) err
 
 		if err != nil {
 			if err == errNoSuchVolume {
+				cattleSaveRetries.WithLabelValues("not_found").Inc()
 				time.Sleep(time.Second)
 				continue
 			} else {
@@ -102,9 +103,13 @@ func (r *RancherState) Save(name string, options map[string]string, try int) err
 		HostId:          r.hostID,
 	}
 
+	start := time.Now()
 	newVol, err := r.client.Volume.Update(vol, opts)
+	observeCattle("volume.update", start, err)
 	if err == nil && (newVol.State == "inactive" || newVol.State == "registering") {
+		start = time.Now()
 		_, err = r.client.Volume.ActionUpdate(vol)
+		observeCattle("volume.actionUpdate", start, err)
 	}
 
 	logrus.WithField("err", err).Infof("Updating volume %s (%s) %s:%s on %s, state %s => %s",
@@ -116,6 +121,7 @@ func (r *RancherState) Save(name string, options map[string]string, try int) err
 			try++
 			wait := try * 2
 			logrus.Warnf("Error while updating volume %s. Sleeping %d and retrying: %v", vol.Id, wait, err)
+			cattleSaveRetries.WithLabelValues("update_error").Inc()
 			time.Sleep(time.Duration(wait) * time.Second)
 			return r.Save(name, options, try)
 		}
@@ -124,7 +130,55 @@ func (r *RancherState) Save(name string, options map[string]string, try int) err
 	return err
 }
 
+// add creates the Cattle volume that is otherwise created by Rancher before
+// the plugin is called, and saves it
+func (r *RancherState) add(name string, options map[string]string) error {
+	_, _, err := r.getAny(name)
+	if err == errNoSuchVolume {
+		start := time.Now()
+		_, err = r.client.Volume.Create(&client.Volume{
+			Name:            name,
+			Driver:          r.driver,
+			StorageDriverId: r.driverID,
+			DriverOpts:      toMapInterface(options),
+			HostId:          r.hostID,
+		})
+		observeCattle("volume.create", start, err)
+	}
+	if err != nil {
+		return err
+	}
+	return r.Save(name, options, 0)
+}
+
 func (r *RancherState) List() ([]*volume.Volume, error) {
+	vols, err := r.listCreated()
+	if err != nil {
+		return nil, err
+	}
+	result := []*volume.Volume{}
+	for _, vol := range vols {
+		result = append(result, volToVol(vol))
+	}
+
+	return result, nil
+}
+
+func (r *RancherState) listOptions() (map[string]map[string]string, error) {
+	vols, err := r.listCreated()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]string{}
+	for i := range vols {
+		result[vols[i].Name] = getOptions(&vols[i])
+	}
+	return result, nil
+}
+
+// listCreated returns the volumes of the driver that are created, in one call
+func (r *RancherState) listCreated() ([]client.Volume, error) {
+	start := time.Now()
 	vols, err := r.client.Volume.List(&client.ListOpts{
 		Filters: map[string]interface{}{
 			"removed_null":    "true",
@@ -132,24 +186,68 @@ func (r *RancherState) List() ([]*volume.Volume, error) {
 			"storageDriverId": r.driverID,
 		},
 	})
+	observeCattle("volume.list", start, err)
 	if err != nil {
 		return nil, err
 	}
-	result := []*volume.Volume{}
+	result := []client.Volume{}
 	for _, vol := range vols.Data {
 		if isCreated(r.driver, vol) {
-			result = append(result, volToVol(vol))
+			result = append(result, vol)
 		}
 	}
+	return result, nil
+}
+
+func (r *RancherState) ping() error {
+	start := time.Now()
+	_, err := r.client.Volume.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"limit":           "1",
+			"storageDriverId": r.driverID,
+		},
+	})
+	observeCattle("volume.list", start, err)
+	return err
+}
 
+func (r *RancherState) listAll() ([]*volume.Volume, error) {
+	start := time.Now()
+	vols, err := r.client.Volume.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"removed_null":    "true",
+			"limit":           "-1",
+			"storageDriverId": r.driverID,
+		},
+	})
+	observeCattle("volume.list", start, err)
+	if err != nil {
+		return nil, err
+	}
+	result := []*volume.Volume{}
+	for _, vol := range vols.Data {
+		result = append(result, volToVol(vol))
+	}
 	return result, nil
 }
 
+// IsRemoving is true once Rancher has moved the volume to removing. Docker
+// removals are otherwise ignored, the volume is still in use elsewhere.
+func (r *RancherState) IsRemoving(vol *client.Volume) bool {
+	return vol.State == "removing"
+}
+
+// Delete is a no-op, Cattle purges the volume record itself.
+func (r *RancherState) Delete(name string) error {
+	return nil
+}
+
 func isCreated(driver string, vol client.Volume) bool {
 	return goodStates[vol.State]
 }
 
 func (r *RancherState) getAny(name string) (*volume.Volume, *client.Volume, error) {
+	start := time.Now()
 	vols, err := r.client.Volume.List(&client.ListOpts{
 		Filters: map[string]interface{}{
 			"name":            name,
@@ -157,6 +255,7 @@ func (r *RancherState) getAny(name string) (*volume.Volume, *client.Volume, erro
 			"storageDriverId": r.driverID,
 		},
 	})
+	observeCattle("volume.list", start, err)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -169,6 +268,7 @@ func (r *RancherState) getAny(name string) (*volume.Volume, *client.Volume, erro
 }
 
 func (r *RancherState) Get(name string) (*volume.Volume, *client.Volume, error) {
+	start := time.Now()
 	vols, err := r.client.Volume.List(&client.ListOpts{
 		Filters: map[string]interface{}{
 			"name":            name,
@@ -176,6 +276,7 @@ func (r *RancherState) Get(name string) (*volume.Volume, *client.Volume, error)
 			"storageDriverId": r.driverID,
 		},
 	})
+	observeCattle("volume.list", start, err)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -229,7 +330,7 @@ func getDriverID(driver string, c *client.RancherClient) (string, error) {
 	return drivers.Data[0].Id, nil
 }
 
-func getHostID(c *client.RancherClient) (*client.Host, error) {
+func getHostID(metadataURL string, c *client.RancherClient) (*client.Host, error) {
 	m, err := metadata.NewClientAndWait(metadataURL)
 	if err != nil {
 		return nil, errors.Wrap(err, "initializing metadata")
@@ -243,6 +344,9 @@ func getHostID(c *client.RancherClient) (*client.Host, error) {
 			"uuid": mHost.UUID,
 		},
 	})
+	if err != nil {
+		return nil, err
+	}
 	if len(hosts.Data) != 1 {
 		return nil, fmt.Errorf("Failed to find current host %s, got %d host(s)", mHost.UUID, len(hosts.Data))
 	}
@@ -0,0 +1,107 @@
+package volumeplugin
+
+import (
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// reclaimPolicyOption is the driver option setting what happens to the
+// storage of a volume when Rancher removes it
+const reclaimPolicyOption = "reclaimPolicy"
+
+const (
+	// ReclaimRetain keeps the storage
+	ReclaimRetain = "retain"
+	// ReclaimDelete destroys the storage
+	ReclaimDelete = "delete"
+	// ReclaimArchive keeps the data under another name, or in a snapshot,
+	// before deleting the volume
+	ReclaimArchive = "archive"
+)
+
+// Archiver is implemented by backends that can move the data of a volume out
+// of the way, renaming it for example, instead of deleting it.
+type Archiver interface {
+	Archive(name string, options map[string]string) error
+}
+
+func validReclaimPolicy(policy string) error {
+	switch policy {
+	case ReclaimRetain, ReclaimDelete, ReclaimArchive:
+		return nil
+	}
+	return errors.Errorf("Invalid %s %s, must be %s, %s or %s", reclaimPolicyOption, policy, ReclaimRetain, ReclaimDelete, ReclaimArchive)
+}
+
+// SetReclaimPolicy sets the policy of volumes that do not have the
+// reclaimPolicy option. Imported volumes are retained unless they have it.
+func (d *RancherStorageDriver) SetReclaimPolicy(policy string) error {
+	if err := validReclaimPolicy(policy); err != nil {
+		return err
+	}
+	d.reclaimPolicy = policy
+	return nil
+}
+
+// policy returns the reclaim policy of a volume with options. Without a
+// policy of its own, storage the driver adopted rather than created is
+// retained, as is storage rancher-nfs is set to retain.
+func (d *RancherStorageDriver) policy(options map[string]string) (string, error) {
+	if policy := options[reclaimPolicyOption]; policy != "" {
+		return policy, validReclaimPolicy(policy)
+	}
+	if isAdopted(options) {
+		return ReclaimRetain, nil
+	}
+	// onRemove is the option of rancher-nfs before there were policies,
+	// ON_REMOVE its default
+	onRemove := options["onRemove"]
+	if onRemove == "" {
+		onRemove = os.Getenv("ON_REMOVE")
+	}
+	if onRemove == ReclaimRetain {
+		return ReclaimRetain, nil
+	}
+	return d.reclaimPolicy, nil
+}
+
+// reclaim deletes or archives the storage of a removed volume. Only a policy
+// set on the volume is passed to the driver, in its options, and overrides
+// what a script decides by itself, like created of rancher-ebs or onRemove of
+// rancher-nfs.
+func (d *RancherStorageDriver) reclaim(name, policy string, options map[string]string) error {
+	switch policy {
+	case ReclaimRetain:
+		logrus.Infof("Retaining the storage of %s", name)
+		return nil
+	case ReclaimArchive:
+		return d.archive(name, options)
+	}
+	return d.Backend.Delete(name, options)
+}
+
+// archive renames the volume if the backend can, or snapshots and deletes it.
+// A volume that can be neither is not deleted.
+func (d *RancherStorageDriver) archive(name string, options map[string]string) error {
+	if a, ok := d.Backend.(Archiver); ok {
+		err := a.Archive(name, Fold(options))
+		if err != ErrNotSupported {
+			return errors.Wrapf(err, "archiving %s", name)
+		}
+	}
+
+	if s, ok := d.Backend.(Snapshotter); ok {
+		snapshot, err := s.Snapshot(name, "archive-"+time.Now().UTC().Format("20060102150405"), Fold(options))
+		if err == nil {
+			logrus.Infof("Archived %s in snapshot %s, deleting it", name, snapshot.ID)
+			return d.Backend.Delete(name, options)
+		} else if err != ErrNotSupported {
+			return errors.Wrapf(err, "snapshotting %s to archive it", name)
+		}
+	}
+
+	return errors.Errorf("%s can not be archived, %s supports neither archive nor snapshot", name, d.DriverName)
+}
@@ -0,0 +1,75 @@
+package volumeplugin
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	defer os.Setenv("ON_REMOVE", os.Getenv("ON_REMOVE"))
+
+	tests := []struct {
+		name     string
+		options  map[string]string
+		onRemove string
+		want     string
+		invalid  bool
+	}{
+		{name: "default", options: map[string]string{"created": "true"}, want: ReclaimArchive},
+		{name: "explicit", options: map[string]string{reclaimPolicyOption: ReclaimDelete}, want: ReclaimDelete},
+		{name: "explicit on adopted", options: map[string]string{ownershipOption: ownershipAdopted, reclaimPolicyOption: ReclaimDelete}, want: ReclaimDelete},
+		{name: "invalid", options: map[string]string{reclaimPolicyOption: "shred"}, invalid: true},
+		{name: "adopted", options: map[string]string{ownershipOption: ownershipAdopted}, want: ReclaimRetain},
+		{name: "onRemove retain", options: map[string]string{"onRemove": "retain"}, want: ReclaimRetain},
+		{name: "onRemove purge", options: map[string]string{"onRemove": "purge"}, onRemove: "retain", want: ReclaimArchive},
+		{name: "ON_REMOVE retain", options: map[string]string{}, onRemove: "retain", want: ReclaimRetain},
+	}
+
+	d := &RancherStorageDriver{reclaimPolicy: ReclaimArchive}
+	for _, test := range tests {
+		os.Setenv("ON_REMOVE", test.onRemove)
+		got, err := d.policy(test.options)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: expected %s, got %s, %v", test.name, test.want, got, err)
+		}
+	}
+}
+
+// deleteRecorder records the options the volumes are deleted with
+type deleteRecorder struct {
+	Backend
+	deleted map[string]map[string]string
+}
+
+func (b *deleteRecorder) Delete(name string, options map[string]string) error {
+	b.deleted[name] = options
+	return nil
+}
+
+func TestReclaimPassesOnlyExplicitPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+	}{
+		{name: "default", options: map[string]string{"volumeID": "vol-1"}},
+		{name: "explicit", options: map[string]string{"volumeID": "vol-2", reclaimPolicyOption: ReclaimDelete}},
+	}
+
+	b := &deleteRecorder{deleted: map[string]map[string]string{}}
+	d := &RancherStorageDriver{Backend: b, reclaimPolicy: ReclaimDelete}
+	for _, test := range tests {
+		if err := d.reclaim(test.name, ReclaimDelete, test.options); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := b.deleted[test.name]; !reflect.DeepEqual(got, test.options) {
+			t.Errorf("%s: expected delete with %v, got %v", test.name, test.options, got)
+		}
+	}
+}
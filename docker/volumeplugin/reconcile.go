@@ -0,0 +1,169 @@
+package volumeplugin
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DriftOrphan is a volume the backend holds that is not in the state
+	DriftOrphan = "orphan"
+	// DriftMissing is a volume in the state the backend does not hold
+	DriftMissing = "missing"
+	// DriftMismatch is a volume whose options differ between the state and
+	// the backend
+	DriftMismatch = "mismatch"
+)
+
+// BackendVolume is a volume held by a backend. Name is empty for backends
+// that do not know the names of their volumes, they are matched to the state
+// by their volumeID option. Owned is set by backends that mark the volumes
+// they create, so they are not mistaken for storage created by others.
+type BackendVolume struct {
+	Name    string            `json:"name"`
+	Owned   bool              `json:"owned"`
+	Options map[string]string `json:"options"`
+}
+
+// Lister is implemented by backends that can list the volumes they hold.
+// options select where to list, a pool or an export for example.
+type Lister interface {
+	List(options map[string]string) ([]BackendVolume, error)
+}
+
+// Drift is a difference between a backend and the state
+type Drift struct {
+	Kind string
+	Name string
+	// Options are those of the state, or of the backend for orphans
+	Options map[string]string
+	// Backend are the options of the backend for mismatches
+	Backend map[string]string
+	// Mismatched are the options that differ
+	Mismatched []string
+	// Owned is set for orphans the backend marked as its own
+	Owned bool
+}
+
+// Reconcile diffs the volumes backend holds against those in state. Volumes
+// in the state with a different value for one of options are held elsewhere
+// and are skipped.
+func Reconcile(backend Backend, state StateStore, options map[string]string) ([]Drift, error) {
+	lister, ok := backend.(Lister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	held, err := lister.List(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing backend volumes")
+	}
+
+	vols, err := state.listOptions()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing volumes")
+	}
+	known := map[string]map[string]string{}
+	byID := map[string]string{}
+	for name, volOptions := range vols {
+		if !inScope(volOptions, options) {
+			continue
+		}
+		known[name] = volOptions
+		if id := volOptions["volumeID"]; id != "" {
+			byID[id] = name
+		}
+	}
+
+	var result []Drift
+	matched := map[string]bool{}
+	for _, vol := range held {
+		name := vol.Name
+		if name == "" {
+			name = byID[vol.Options["volumeID"]]
+		}
+		volOptions, ok := known[name]
+		if name == "" || !ok {
+			result = append(result, Drift{
+				Kind:    DriftOrphan,
+				Name:    vol.Name,
+				Options: vol.Options,
+				Owned:   vol.Owned,
+			})
+			continue
+		}
+
+		matched[name] = true
+		if keys := mismatched(volOptions, vol.Options); len(keys) > 0 {
+			result = append(result, Drift{
+				Kind:       DriftMismatch,
+				Name:       name,
+				Options:    volOptions,
+				Backend:    vol.Options,
+				Mismatched: keys,
+			})
+		}
+	}
+
+	for name, volOptions := range known {
+		if !matched[name] {
+			result = append(result, Drift{
+				Kind:    DriftMissing,
+				Name:    name,
+				Options: volOptions,
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Kind != result[j].Kind {
+			return result[i].Kind < result[j].Kind
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// ImportOrphan imports an orphan with the options reported by the backend
+func ImportOrphan(backend Backend, state StateStore, drift Drift) error {
+	if drift.Kind != DriftOrphan {
+		return errors.Errorf("%s is not an orphan", drift.Name)
+	}
+	if drift.Name == "" {
+		return errors.New("the backend does not know the name of the volume")
+	}
+	return ImportVolume(backend, state, drift.Name, drift.Options)
+}
+
+// DeleteOrphan destroys the storage of an orphan, as long as the backend
+// marked it as its own
+func DeleteOrphan(backend Backend, drift Drift) error {
+	if drift.Kind != DriftOrphan {
+		return errors.Errorf("%s is not an orphan", drift.Name)
+	}
+	if !drift.Owned {
+		return errors.New("the driver can not tell that it created the volume")
+	}
+	return backend.Delete(drift.Name, drift.Options)
+}
+
+func inScope(volOptions, options map[string]string) bool {
+	for k, v := range options {
+		if value, ok := volOptions[k]; ok && value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// mismatched returns the options both have with different values
+func mismatched(volOptions, backendOptions map[string]string) []string {
+	var keys []string
+	for k, v := range backendOptions {
+		if value, ok := volOptions[k]; ok && value != v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
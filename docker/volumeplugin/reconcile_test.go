@@ -0,0 +1,85 @@
+package volumeplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// listBackend holds the volumes it lists
+type listBackend struct {
+	Backend
+	volumes []BackendVolume
+	deleted []string
+}
+
+func (b *listBackend) List(options map[string]string) ([]BackendVolume, error) {
+	return b.volumes, nil
+}
+
+func (b *listBackend) Delete(name string, options map[string]string) error {
+	b.deleted = append(b.deleted, name)
+	return nil
+}
+
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reconcile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state, err := NewLocalState("rancher-loop", dir, "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, options := range map[string]map[string]string{
+		"same":      {"volumeID": "vol-1", "size": "1"},
+		"resized":   {"volumeID": "vol-2", "size": "1"},
+		"byid":      {"volumeID": "vol-3"},
+		"gone":      {"volumeID": "vol-4"},
+		"elsewhere": {"volumeID": "vol-5", "pool": "other"},
+	} {
+		if err := state.Save(name, options, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := &listBackend{volumes: []BackendVolume{
+		{Name: "same", Options: map[string]string{"volumeID": "vol-1", "size": "1"}},
+		{Name: "resized", Options: map[string]string{"volumeID": "vol-2", "size": "2"}},
+		{Options: map[string]string{"volumeID": "vol-3"}},
+		{Name: "stray", Owned: true, Options: map[string]string{"volumeID": "vol-6"}},
+		{Options: map[string]string{"volumeID": "vol-7"}},
+	}}
+	drifts, err := Reconcile(backend, state, map[string]string{"pool": "rbd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Drift{
+		{Kind: DriftMismatch, Name: "resized", Options: map[string]string{"volumeID": "vol-2", "size": "1"}, Backend: map[string]string{"volumeID": "vol-2", "size": "2"}, Mismatched: []string{"size"}},
+		{Kind: DriftMissing, Name: "gone", Options: map[string]string{"volumeID": "vol-4"}},
+		{Kind: DriftOrphan, Name: "", Options: map[string]string{"volumeID": "vol-7"}},
+		{Kind: DriftOrphan, Name: "stray", Options: map[string]string{"volumeID": "vol-6"}, Owned: true},
+	}
+	if len(drifts) != len(want) {
+		t.Fatalf("expected %d drifts, got %+v", len(want), drifts)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(drifts[i], want[i]) {
+			t.Errorf("expected %+v, got %+v", want[i], drifts[i])
+		}
+	}
+
+	// only orphans the driver marked as its own are deleted
+	for _, drift := range drifts[2:] {
+		err := DeleteOrphan(backend, drift)
+		if drift.Owned != (err == nil) {
+			t.Errorf("%+v: expected deleting it to fail unless owned, got %v", drift, err)
+		}
+	}
+	if !reflect.DeepEqual(backend.deleted, []string{"stray"}) {
+		t.Errorf("expected only stray to be deleted, got %v", backend.deleted)
+	}
+}
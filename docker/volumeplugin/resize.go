@@ -0,0 +1,75 @@
+package volumeplugin
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// Resizer is implemented by backends that can grow a volume, and the
+// filesystem on it, while it is in use. mntDest is empty when the volume is
+// not mounted on this host.
+type Resizer interface {
+	Resize(name, size, mntDest string, options map[string]string) error
+}
+
+type ResizeRequest struct {
+	Name string
+	// Size is the new size, in the same unit as the size option of the driver
+	Size string
+}
+
+func (d *RancherStorageDriver) Resize(request ResizeRequest) volume.Response {
+	defer d.lockVolume(request.Name)()
+
+	logrus.WithFields(logrus.Fields{
+		"name": request.Name,
+		"size": request.Size,
+	}).Info("resize.request")
+
+	response := volume.Response{}
+	defer logResponse("resize", request.Name, &response)
+	defer observeOperation("resize", time.Now(), &response.Err)
+
+	r, ok := d.Backend.(Resizer)
+	if !ok {
+		response.Err = ErrNotSupported.Error()
+		return response
+	}
+
+	if request.Size == "" {
+		response.Err = "size is required"
+		return response
+	}
+
+	_, rVol, err := d.state.Get(request.Name)
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	mntDest := d.getMntDest(request.Name)
+	if mounted, err := d.isMounted(mntDest); err != nil {
+		response.Err = err.Error()
+		return response
+	} else if !mounted {
+		mntDest = ""
+	}
+
+	options := getOptions(rVol)
+	if err := r.Resize(request.Name, request.Size, mntDest, options); err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	options = getOptions(rVol)
+	options["size"] = request.Size
+	if err := d.state.Save(request.Name, options, 0); err != nil {
+		logrus.Errorf("Save volume name=%s failed, err: %s", request.Name, err)
+		response.Err = err.Error()
+		return response
+	}
+
+	return response
+}
@@ -0,0 +1,183 @@
+package volumeplugin
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// stderrTailBytes is how much of the end of stderr a failed call reports
+	stderrTailBytes = 1024
+	// maxStderrLine splits lines that never end, binary output for example
+	maxStderrLine = 64 * 1024
+)
+
+// stderrLogger is the stderr of a driver script call. Every line is logged
+// through logrus as it is written, with the fields of the call, and the end
+// of the output is kept for the error of a failed call. Lines written by
+// log_message of common.sh are logfmt, their level, message and fields are
+// kept.
+type stderrLogger struct {
+	fields logrus.Fields
+	line   []byte
+	tail   []byte
+	cut    bool
+}
+
+func newStderrLogger(fields logrus.Fields) *stderrLogger {
+	return &stderrLogger{
+		fields: fields,
+	}
+}
+
+func (l *stderrLogger) Write(p []byte) (int, error) {
+	l.tail = append(l.tail, p...)
+	if len(l.tail) > stderrTailBytes {
+		l.tail = l.tail[len(l.tail)-stderrTailBytes:]
+		l.cut = true
+	}
+
+	l.line = append(l.line, p...)
+	for {
+		i := bytes.IndexByte(l.line, '\n')
+		if i < 0 {
+			break
+		}
+		l.log(string(l.line[:i]))
+		l.line = l.line[i+1:]
+	}
+	if len(l.line) > maxStderrLine {
+		l.Flush()
+	}
+	return len(p), nil
+}
+
+// Flush logs what is left after the last newline
+func (l *stderrLogger) Flush() {
+	if len(l.line) > 0 {
+		l.log(string(l.line))
+		l.line = nil
+	}
+}
+
+// Tail is the end of stderr, starting at a line if it was cut
+func (l *stderrLogger) Tail() string {
+	tail := l.tail
+	if l.cut {
+		if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+			tail = tail[i+1:]
+		}
+	}
+	return strings.TrimSpace(string(tail))
+}
+
+func (l *stderrLogger) log(line string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	fields := logrus.Fields{}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+
+	values, ok := parseLogfmt(line)
+	if !ok || values["msg"] == "" {
+		logrus.WithFields(fields).Info(line)
+		return
+	}
+
+	level, err := logrus.ParseLevel(values["level"])
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	for k, v := range values {
+		switch k {
+		case "time", "level", "msg":
+		default:
+			fields[k] = v
+		}
+	}
+
+	entry := logrus.WithFields(fields)
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		entry.Error(values["msg"])
+	case logrus.WarnLevel:
+		entry.Warn(values["msg"])
+	case logrus.DebugLevel:
+		entry.Debug(values["msg"])
+	default:
+		entry.Info(values["msg"])
+	}
+}
+
+// parseLogfmt parses key=value pairs where values are bare words or double
+// quoted with backslash escapes, and fails on anything else. log_message does
+// not escape quotes, so only a quote followed by the next key ends a value.
+func parseLogfmt(line string) (map[string]string, bool) {
+	values := map[string]string{}
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+
+		eq := strings.IndexByte(line[i:], '=')
+		if eq <= 0 {
+			return nil, false
+		}
+		key := line[i : i+eq]
+		if strings.ContainsAny(key, " \"") {
+			return nil, false
+		}
+		i += eq + 1
+
+		var value []byte
+		if i < len(line) && line[i] == '"' {
+			i++
+			closed := false
+			for ; i < len(line); i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					value = append(value, line[i])
+				} else if line[i] == '"' && endsValue(line[i+1:]) {
+					i++
+					closed = true
+					break
+				} else {
+					value = append(value, line[i])
+				}
+			}
+			if !closed {
+				return nil, false
+			}
+		} else {
+			for ; i < len(line) && line[i] != ' '; i++ {
+				value = append(value, line[i])
+			}
+		}
+		values[key] = string(value)
+	}
+	return values, len(values) > 0
+}
+
+// endsValue returns true if rest, what follows a quote, is empty or starts
+// with the next key
+func endsValue(rest string) bool {
+	if rest == "" {
+		return true
+	}
+	if rest[0] != ' ' {
+		return false
+	}
+	rest = strings.TrimLeft(rest, " ")
+	if rest == "" {
+		return true
+	}
+	eq := strings.IndexByte(rest, '=')
+	return eq > 0 && !strings.ContainsAny(rest[:eq], " \"")
+}
@@ -0,0 +1,137 @@
+package volumeplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestParseLogfmt(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]string
+	}{
+		{
+			line: `time="2018-01-02T03:04:05Z" level=info msg="Attached vol-1" name=attach`,
+			want: map[string]string{"time": "2018-01-02T03:04:05Z", "level": "info", "msg": "Attached vol-1", "name": "attach"},
+		},
+		{
+			line: `level=error msg="quoted "value" inside" name=mount`,
+			want: map[string]string{"level": "error", "msg": `quoted "value" inside`, "name": "mount"},
+		},
+		{
+			line: `msg="escaped \" quote" key=value`,
+			want: map[string]string{"msg": `escaped " quote`, "key": "value"},
+		},
+		{
+			line: `msg=""`,
+			want: map[string]string{"msg": ""},
+		},
+		{line: `mke2fs 1.42.9 (28-Dec-2013)`},
+		{line: `msg="never closed`},
+		{line: `=value`},
+		{line: ``},
+	}
+
+	for _, test := range tests {
+		got, ok := parseLogfmt(test.line)
+		if ok != (test.want != nil) || ok && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v, %v", test.line, test.want, got, ok)
+		}
+	}
+}
+
+func TestStderrLoggerForwardsLines(t *testing.T) {
+	logger := logrus.StandardLogger()
+	defer logrus.SetOutput(logger.Out)
+	defer logrus.SetFormatter(logger.Formatter)
+	defer logrus.SetLevel(logger.Level)
+
+	tests := []struct {
+		name   string
+		writes []string
+		want   []map[string]interface{}
+		tail   string
+	}{
+		{
+			name:   "plain lines",
+			writes: []string{"first\nsec", "ond\n\n", "third"},
+			want: []map[string]interface{}{
+				{"level": "info", "msg": "first"},
+				{"level": "info", "msg": "second"},
+				{"level": "info", "msg": "third"},
+			},
+			tail: "first\nsecond\n\nthird",
+		},
+		{
+			name:   "log_message",
+			writes: []string{`time="2018-01-02T03:04:05Z" level=warn msg="Retrying attach" name=attach` + "\n"},
+			want: []map[string]interface{}{
+				{"level": "warning", "msg": "Retrying attach", "name": "attach"},
+			},
+		},
+		{
+			name:   "unknown level",
+			writes: []string{`level=loud msg=hello` + "\r\n"},
+			want: []map[string]interface{}{
+				{"level": "info", "msg": "hello"},
+			},
+		},
+		{
+			name:   "debug",
+			writes: []string{`level=debug msg=details` + "\n"},
+			want: []map[string]interface{}{
+				{"level": "debug", "msg": "details"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		logrus.SetOutput(out)
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+		logrus.SetLevel(logrus.DebugLevel)
+
+		l := newStderrLogger(logrus.Fields{"command": "attach"})
+		for _, w := range test.writes {
+			l.Write([]byte(w))
+		}
+		l.Flush()
+
+		var got []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			entry := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if entry["command"] != "attach" {
+				t.Errorf("%s: expected the fields of the call in %v", test.name, entry)
+			}
+			delete(entry, "command")
+			delete(entry, "time")
+			got = append(got, entry)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+		if test.tail != "" && l.Tail() != test.tail {
+			t.Errorf("%s: expected tail %q, got %q", test.name, test.tail, l.Tail())
+		}
+	}
+}
+
+func TestStderrTailStartsAtALine(t *testing.T) {
+	logger := logrus.StandardLogger()
+	defer logrus.SetOutput(logger.Out)
+	logrus.SetOutput(&bytes.Buffer{})
+
+	l := newStderrLogger(logrus.Fields{})
+	l.Write([]byte(strings.Repeat("x", stderrTailBytes) + "\nlast line\n"))
+	if l.Tail() != "last line" {
+		t.Fatalf("expected the tail to start after the cut line, got %q", l.Tail())
+	}
+}
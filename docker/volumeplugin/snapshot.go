@@ -0,0 +1,141 @@
+package volumeplugin
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type Snapshot struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Created string `json:"created"`
+}
+
+// Snapshotter is implemented by backends that can take point in time copies
+// of a volume.
+type Snapshotter interface {
+	Snapshot(name, snapshotName string, options map[string]string) (*Snapshot, error)
+	ListSnapshots(name string, options map[string]string) ([]Snapshot, error)
+	DeleteSnapshot(name, snapshotID string, options map[string]string) error
+}
+
+type SnapshotRequest struct {
+	Name string
+	// Snapshot is the name of the snapshot to take, or the ID of the
+	// snapshot to delete
+	Snapshot string
+}
+
+type SnapshotResponse struct {
+	Err       string
+	Snapshot  *Snapshot  `json:",omitempty"`
+	Snapshots []Snapshot `json:",omitempty"`
+}
+
+func (d *RancherStorageDriver) snapshotter() (Snapshotter, error) {
+	if s, ok := d.Backend.(Snapshotter); ok {
+		return s, nil
+	}
+	return nil, ErrNotSupported
+}
+
+func (d *RancherStorageDriver) Snapshot(request SnapshotRequest) SnapshotResponse {
+	defer d.lockVolume(request.Name)()
+
+	logrus.WithFields(logrus.Fields{
+		"name":     request.Name,
+		"snapshot": request.Snapshot,
+	}).Info("snapshot.request")
+
+	response := SnapshotResponse{}
+	defer logSnapshotResponse("snapshot", request.Name, &response)
+	defer observeOperation("snapshot", time.Now(), &response.Err)
+
+	s, err := d.snapshotter()
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	_, rVol, err := d.state.Get(request.Name)
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	response.Snapshot, err = s.Snapshot(request.Name, request.Snapshot, getOptions(rVol))
+	if err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func (d *RancherStorageDriver) ListSnapshots(request SnapshotRequest) SnapshotResponse {
+	defer d.lockVolume(request.Name)()
+
+	response := SnapshotResponse{}
+	defer observeOperation("list-snapshots", time.Now(), &response.Err)
+
+	s, err := d.snapshotter()
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	_, rVol, err := d.state.Get(request.Name)
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	response.Snapshots, err = s.ListSnapshots(request.Name, getOptions(rVol))
+	if err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func (d *RancherStorageDriver) DeleteSnapshot(request SnapshotRequest) SnapshotResponse {
+	defer d.lockVolume(request.Name)()
+
+	logrus.WithFields(logrus.Fields{
+		"name":     request.Name,
+		"snapshot": request.Snapshot,
+	}).Info("delete-snapshot.request")
+
+	response := SnapshotResponse{}
+	defer logSnapshotResponse("delete-snapshot", request.Name, &response)
+	defer observeOperation("delete-snapshot", time.Now(), &response.Err)
+
+	s, err := d.snapshotter()
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	_, rVol, err := d.state.Get(request.Name)
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	if err := s.DeleteSnapshot(request.Name, request.Snapshot, getOptions(rVol)); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func logSnapshotResponse(action, name string, response *SnapshotResponse) {
+	fields := logrus.Fields{}
+	fields["name"] = name
+	if response.Snapshot != nil {
+		fields["snapshot"] = response.Snapshot.ID
+	}
+	if response.Err != "" {
+		fields["error"] = response.Err
+		logrus.WithFields(fields).Errorf("%s.response", action)
+	} else {
+		logrus.WithFields(fields).Infof("%s.response", action)
+	}
+}
@@ -27,3 +27,9 @@ func ForceSymlinkInDockerPlugins(driver string) error {
 func RancherSocketFile(driver string) string {
 	return filepath.Join(rancherSockDir, driver+".sock")
 }
+
+// ManagedSocketFile is where Docker looks for the socket named in the
+// config.json of a managed plugin, no symlink is needed.
+func ManagedSocketFile(driver string) string {
+	return filepath.Join(dockerSockDir, driver+".sock")
+}
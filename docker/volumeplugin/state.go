@@ -0,0 +1,34 @@
+package volumeplugin
+
+import (
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/rancher/go-rancher/v2"
+)
+
+// StateStore records the volumes known to the plugin and their driver
+// options. RancherState keeps them in Cattle, LocalState in a file on the
+// host so the plugin can run without a Rancher server.
+type StateStore interface {
+	IsCreated(name string) (bool, error)
+	Save(name string, options map[string]string, try int) error
+	Get(name string) (*volume.Volume, *client.Volume, error)
+	List() ([]*volume.Volume, error)
+	// IsRemoving reports whether vol is being removed by the owner of the
+	// state, in which case a Docker remove should destroy the backing storage.
+	IsRemoving(vol *client.Volume) bool
+	// Delete forgets about the volume once its storage has been removed.
+	Delete(name string) error
+
+	// add records a volume whose storage was not created through Docker
+	add(name string, options map[string]string) error
+
+	// listOptions returns the options of the listed volumes by name, in one
+	// read of the state
+	listOptions() (map[string]map[string]string, error)
+
+	// ping checks that the state can be read, without listing it
+	ping() error
+
+	getAny(name string) (*volume.Volume, *client.Volume, error)
+	listAll() ([]*volume.Volume, error)
+}
@@ -0,0 +1,289 @@
+package volumeplugin
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/v2"
+)
+
+const (
+	// trashIDOption names where the backend moves the storage of a trashed
+	// volume
+	trashIDOption = "trashID"
+	// trashOption is the record of trashed storage, the backend keeps it with
+	// the storage and lists it back with the trashID option
+	trashOption = "trash"
+	// trashedOption asks the list of the backend for its trashed storage
+	trashedOption = "trashed"
+	reapInterval  = time.Minute
+)
+
+// Trasher is implemented by backends that can move the storage of a removed
+// volume aside, renaming or tagging it, so it can be restored until it is
+// deleted. Trash must succeed when called again with the same trashID
+// option, and returns the options of the trashed storage. The backend keeps
+// the trash option with the storage, and lists the trashed storage with its
+// trashID and trash options when List is called with the trashed option, so
+// the trash is the same on every host.
+type Trasher interface {
+	Trash(name string, options map[string]string) (map[string]string, error)
+	Restore(name string, options map[string]string, trashedName string, trashed map[string]string) (map[string]string, error)
+}
+
+// TrashEntry is a removed volume whose storage is kept until Expires
+type TrashEntry struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Options are those of the volume, Trashed those of the trashed storage
+	Options map[string]string `json:"options,omitempty"`
+	Trashed map[string]string `json:"trashed,omitempty"`
+	// Policy is applied to the trashed storage once it expires
+	Policy  string    `json:"policy"`
+	Removed time.Time `json:"removed"`
+	Expires time.Time `json:"expires"`
+}
+
+// record is the trash option of e. It is plain text, the options of the
+// scripts do not carry JSON and EBS tags allow few characters.
+func (e *TrashEntry) record() string {
+	return strings.Join([]string{e.Policy, e.Removed.Format(time.RFC3339), e.Expires.Format(time.RFC3339), e.Name}, " ")
+}
+
+func parseTrashRecord(id, record string) (*TrashEntry, error) {
+	fields := strings.SplitN(record, " ", 4)
+	if id == "" || len(fields) != 4 {
+		return nil, errors.Errorf("invalid trash record %q of %q", record, id)
+	}
+	removed, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return nil, err
+	}
+	expires, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return nil, err
+	}
+	return &TrashEntry{
+		ID:      id,
+		Name:    fields[3],
+		Policy:  fields[0],
+		Removed: removed,
+		Expires: expires,
+	}, nil
+}
+
+// trashedName is the name the backend knows the trashed storage by
+func (e *TrashEntry) trashedName() string {
+	if name := e.Trashed["name"]; name != "" {
+		return name
+	}
+	return e.Name
+}
+
+type UndeleteRequest struct {
+	Name string
+	// ID selects the trash entry, the latest one of Name by default
+	ID string
+}
+
+type TrashResponse struct {
+	Err   string
+	Trash []TrashEntry `json:",omitempty"`
+}
+
+// trashID names the trashed storage of vol after the volume rather than the
+// host or the time, every host that removes it trashes it to the same place
+func trashID(name string, vol *client.Volume, options map[string]string) string {
+	identity := vol.Uuid
+	if identity == "" {
+		identity = options["volumeID"]
+	}
+	if identity == "" {
+		identity = vol.Created
+	}
+	sum := sha1.Sum([]byte(identity))
+	return name + "-" + hex.EncodeToString(sum[:4])
+}
+
+// SetTrashTTL sets how long the storage of removed volumes is kept before the
+// reclaim policy is applied, 0 applies it on removal.
+func (d *RancherStorageDriver) SetTrashTTL(ttl time.Duration) {
+	d.trashTTL = ttl
+}
+
+// trashVolume moves the storage of a removed volume aside until the trash
+// TTL expires. A remove that is retried trashes the storage again under the
+// same ID.
+func (d *RancherStorageDriver) trashVolume(name, policy string, vol *client.Volume, options map[string]string) error {
+	t, ok := d.Backend.(Trasher)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	e := &TrashEntry{
+		ID:      trashID(name, vol, options),
+		Name:    name,
+		Policy:  policy,
+		Removed: now,
+		Expires: now.Add(d.trashTTL),
+	}
+	if _, err := t.Trash(name, Fold(options, map[string]string{
+		trashIDOption: e.ID,
+		trashOption:   e.record(),
+	})); err != nil {
+		return err
+	}
+	logrus.Infof("Trashed %s as %s until %v", name, e.ID, e.Expires)
+	return nil
+}
+
+// trashEntries lists the trash kept by the backend, oldest first
+func (d *RancherStorageDriver) trashEntries() ([]*TrashEntry, error) {
+	lister, ok := d.Backend.(Lister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	vols, err := lister.List(map[string]string{trashedOption: "true"})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing the trash")
+	}
+
+	var result []*TrashEntry
+	for _, vol := range vols {
+		e, err := parseTrashRecord(vol.Options[trashIDOption], vol.Options[trashOption])
+		if err != nil {
+			logrus.Errorf("Ignoring trashed storage %v: %v", vol.Options, err)
+			continue
+		}
+		e.Trashed = vol.Options
+		e.Options = map[string]string{}
+		for k, v := range vol.Options {
+			if k != "name" && k != "volumeID" && k != trashIDOption && k != trashOption {
+				e.Options[k] = v
+			}
+		}
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Removed.Before(result[j].Removed)
+	})
+	return result, nil
+}
+
+// findTrash returns the entry id of name, or its latest entry if id is empty
+func (d *RancherStorageDriver) findTrash(name, id string) (*TrashEntry, error) {
+	entries, err := d.trashEntries()
+	if err != nil {
+		return nil, err
+	}
+	var found *TrashEntry
+	for _, e := range entries {
+		if e.Name == name && (id == "" || e.ID == id) {
+			found = e
+		}
+	}
+	if found == nil {
+		return nil, errors.Errorf("%s is not in the trash", name)
+	}
+	return found, nil
+}
+
+// reapTrash applies the reclaim policy to the trashed storage that expired
+func (d *RancherStorageDriver) reapTrash() {
+	for {
+		entries, err := d.trashEntries()
+		if err != nil && err != ErrNotSupported {
+			logrus.Errorf("Failed to read the trash: %v", err)
+		}
+		for _, e := range entries {
+			d.reap(e, time.Now())
+		}
+		time.Sleep(reapInterval)
+	}
+}
+
+func (d *RancherStorageDriver) reap(e *TrashEntry, now time.Time) {
+	if now.Before(e.Expires) {
+		return
+	}
+
+	defer d.lockVolume(e.Name)()
+	// the trashID option lets the backend check that the storage was not
+	// restored meanwhile, by another host for example
+	if err := d.reclaim(e.trashedName(), e.Policy, e.Trashed); err != nil {
+		logrus.Errorf("Failed to %s %s from the trash, retrying: %v", e.Policy, e.ID, err)
+		return
+	}
+	logrus.Infof("Reclaimed %s from the trash with policy %s", e.ID, e.Policy)
+}
+
+// ListTrash returns the removed volumes that can be restored
+func (d *RancherStorageDriver) ListTrash(request UndeleteRequest) TrashResponse {
+	response := TrashResponse{}
+	entries, err := d.trashEntries()
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+	for _, e := range entries {
+		if request.Name == "" || e.Name == request.Name {
+			response.Trash = append(response.Trash, *e)
+		}
+	}
+	return response
+}
+
+// Undelete restores the storage of a removed volume and saves the volume
+// again
+func (d *RancherStorageDriver) Undelete(request UndeleteRequest) volume.Response {
+	defer d.lockVolume(request.Name)()
+
+	logrus.WithFields(logrus.Fields{
+		"name": request.Name,
+		"id":   request.ID,
+	}).Info("undelete.request")
+
+	response := volume.Response{}
+	defer logResponse("undelete", request.Name, &response)
+	defer observeOperation("undelete", time.Now(), &response.Err)
+
+	t, ok := d.Backend.(Trasher)
+	if !ok {
+		response.Err = ErrNotSupported.Error()
+		return response
+	}
+
+	e, err := d.findTrash(request.Name, request.ID)
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+
+	if created, err := d.state.IsCreated(e.Name); err != nil {
+		response.Err = err.Error()
+		return response
+	} else if created {
+		response.Err = errors.Errorf("Volume %s already exists", e.Name).Error()
+		return response
+	}
+
+	restored, err := t.Restore(e.Name, Fold(e.Options), e.trashedName(), Fold(e.Trashed))
+	if err != nil {
+		response.Err = err.Error()
+		return response
+	}
+	if err := d.state.add(e.Name, Fold(e.Options, restored)); err != nil {
+		logrus.Errorf("Restored the storage of %s but failed to save it, import it to use it: %v", e.ID, err)
+		response.Err = err.Error()
+		return response
+	}
+	logrus.Infof("Restored %s from %s", e.Name, e.ID)
+	return response
+}
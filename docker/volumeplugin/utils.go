@@ -21,18 +21,12 @@ func logRequest(action string, request *volume.Request) {
 	logrus.WithFields(fields).Infof("%s.request", action)
 }
 
-func logResponse(action, name string, response *volume.Response, output *CmdOutput) {
+func logResponse(action, name string, response *volume.Response) {
 	fields := logrus.Fields{}
 	fields["name"] = name
 	if response.Mountpoint != "" {
 		fields["mountpoint"] = response.Mountpoint
 	}
-	if output.Message != "" {
-		fields["message"] = output.Message
-	}
-	if output.Status != "" {
-		fields["status"] = output.Status
-	}
 	if response.Err != "" {
 		fields["error"] = response.Err
 		logrus.WithFields(fields).Errorf("%s.response", action)
@@ -71,7 +65,8 @@ func getOptions(vol *client.Volume) map[string]string {
 	return result
 }
 
-func fold(data ...map[string]string) map[string]string {
+// Fold merges the maps into a new one, later maps win
+func Fold(data ...map[string]string) map[string]string {
 	result := map[string]string{}
 	for _, d := range data {
 		for k, v := range d {
@@ -0,0 +1,197 @@
+package csiplugin
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/rancher/storage/docker/volumeplugin"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	fsTypeOption = "fs-type"
+	// capacityOption is the size requested by the CO in bytes, drivers use it
+	// when the size option of the driver is not set
+	capacityOption = "capacityBytes"
+)
+
+func (s *Server) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume name is required")
+	}
+	if err := checkCapabilities(req.VolumeCapabilities); err != nil {
+		return nil, err
+	}
+
+	options := map[string]string{}
+	for k, v := range req.Parameters {
+		options[k] = v
+	}
+	for _, c := range req.VolumeCapabilities {
+		if m := c.GetMount(); m != nil && m.FsType != "" && options[fsTypeOption] == "" {
+			options[fsTypeOption] = m.FsType
+		}
+	}
+	var capacity int64
+	if req.CapacityRange != nil && req.CapacityRange.RequiredBytes > 0 {
+		capacity = req.CapacityRange.RequiredBytes
+		options[capacityOption] = strconv.FormatInt(capacity, 10)
+	}
+
+	response := s.driver.Create(volume.Request{
+		Name:    req.Name,
+		Options: options,
+	})
+	if err := responseError(response.Err); err != nil {
+		return nil, err
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			Id:            req.Name,
+			CapacityBytes: capacity,
+		},
+	}, nil
+}
+
+func (s *Server) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+
+	response := s.driver.Delete(volume.Request{Name: req.VolumeId})
+	if err := responseError(response.Err); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume is not advertised, volumes are attached when they
+// are staged. It only attaches volumes to the node the plugin runs on, for COs
+// that call it regardless.
+func (s *Server) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.VolumeId == "" || req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID and node ID are required")
+	}
+	if req.NodeId != s.nodeID {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s can only attach volumes to %s", s.name, s.nodeID)
+	}
+
+	response := s.driver.Attach(volumeplugin.AttachRequest{Name: req.VolumeId})
+	if err := responseError(response.Err); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// ControllerUnpublishVolume does nothing, volumes are detached when the last
+// staging of the volume is removed.
+func (s *Server) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (s *Server) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities are required")
+	}
+
+	response := s.driver.Get(volume.Request{Name: req.VolumeId})
+	if err := responseError(response.Err); err != nil {
+		return nil, err
+	}
+
+	if err := checkCapabilities(req.VolumeCapabilities); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Supported: false,
+			Message:   status.Convert(err).Message(),
+		}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{Supported: true}, nil
+}
+
+func (s *Server) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	response := s.driver.List(volume.Request{})
+	if err := responseError(response.Err); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(response.Volumes, func(i, j int) bool {
+		return response.Volumes[i].Name < response.Volumes[j].Name
+	})
+
+	// The token is the index of the next volume in the sorted list
+	start := 0
+	if req.StartingToken != "" {
+		var err error
+		start, err = strconv.Atoi(req.StartingToken)
+		if err != nil || start < 0 || start > len(response.Volumes) {
+			return nil, status.Errorf(codes.Aborted, "Invalid starting token %s", req.StartingToken)
+		}
+	}
+
+	end := len(response.Volumes)
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+	}
+
+	result := &csi.ListVolumesResponse{}
+	for _, vol := range response.Volumes[start:end] {
+		result.Entries = append(result.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{Id: vol.Name},
+		})
+	}
+	if end < len(response.Volumes) {
+		result.NextToken = strconv.Itoa(end)
+	}
+	return result, nil
+}
+
+func (s *Server) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "GetCapacity is not supported")
+}
+
+func (s *Server) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{
+			controllerCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME),
+			controllerCapability(csi.ControllerServiceCapability_RPC_LIST_VOLUMES),
+		},
+	}, nil
+}
+
+func controllerCapability(rpc csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: rpc,
+			},
+		},
+	}
+}
+
+// checkCapabilities accepts mounted volumes in any access mode, whether a
+// volume can be shared between nodes is up to the driver.
+func checkCapabilities(capabilities []*csi.VolumeCapability) error {
+	if len(capabilities) == 0 {
+		return status.Error(codes.InvalidArgument, "Volume capabilities are required")
+	}
+	for _, c := range capabilities {
+		if c.GetMount() == nil {
+			return status.Error(codes.InvalidArgument, "Only mounted volumes are supported")
+		}
+		if c.AccessMode == nil || c.AccessMode.Mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+			return status.Error(codes.InvalidArgument, "Volume access mode is required")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package csiplugin
+
+import (
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/docker/go-plugins-helpers/volume"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NodeStageVolume mounts the volume through the driver, which attaches it
+// first, and bind mounts it on the staging path. The staging path is the ID
+// of the mount so the driver unmounts the volume on the last unstage.
+func (s *Server) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if req.VolumeId == "" || req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID and staging target path are required")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability is required")
+	}
+	if err := checkCapabilities([]*csi.VolumeCapability{req.VolumeCapability}); err != nil {
+		return nil, err
+	}
+
+	response := s.driver.Mount(volume.MountRequest{
+		Name: req.VolumeId,
+		ID:   req.StagingTargetPath,
+	})
+	if err := responseError(response.Err); err != nil {
+		return nil, err
+	}
+
+	if err := s.bindMount(response.Mountpoint, req.StagingTargetPath, false); err != nil {
+		s.driver.Unmount(volume.UnmountRequest{
+			Name: req.VolumeId,
+			ID:   req.StagingTargetPath,
+		})
+		return nil, err
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func (s *Server) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if req.VolumeId == "" || req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID and staging target path are required")
+	}
+
+	if err := s.unmount(req.StagingTargetPath); err != nil {
+		return nil, err
+	}
+
+	response := s.driver.Unmount(volume.UnmountRequest{
+		Name: req.VolumeId,
+		ID:   req.StagingTargetPath,
+	})
+	if err := responseError(response.Err); err != nil {
+		return nil, err
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (s *Server) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.VolumeId == "" || req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID and target path are required")
+	}
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.FailedPrecondition, "Volume must be staged before it is published")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability is required")
+	}
+	if err := checkCapabilities([]*csi.VolumeCapability{req.VolumeCapability}); err != nil {
+		return nil, err
+	}
+
+	if err := s.bindMount(req.StagingTargetPath, req.TargetPath, req.Readonly); err != nil {
+		return nil, err
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (s *Server) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" || req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID and target path are required")
+	}
+
+	if err := s.unmount(req.TargetPath); err != nil {
+		return nil, err
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (s *Server) NodeGetId(ctx context.Context, req *csi.NodeGetIdRequest) (*csi.NodeGetIdResponse, error) {
+	return &csi.NodeGetIdResponse{
+		NodeId: s.nodeID,
+	}, nil
+}
+
+func (s *Server) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// bindMount is idempotent, a target that is already a mount point is left as is
+func (s *Server) bindMount(source, target string, readonly bool) error {
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	notMnt, err := s.mounter.IsLikelyNotMountPoint(target)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		return nil
+	}
+
+	options := []string{"bind"}
+	if readonly {
+		options = append(options, "ro")
+	}
+	if err := s.mounter.Mount(source, target, "", options); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+func (s *Server) unmount(target string) error {
+	notMnt, err := s.mounter.IsLikelyNotMountPoint(target)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if !notMnt {
+		if err := s.mounter.Unmount(target); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
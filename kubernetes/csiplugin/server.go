@@ -0,0 +1,93 @@
+package csiplugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/rancher/storage/docker/volumeplugin"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// Server implements the CSI Identity, Controller and Node services on top of
+// the same RancherStorageDriver that serves the Docker volume plugin API.
+// Volumes are attached by the node that stages them, as the driver scripts
+// only ever attach to the host they run on. The driver runs without Docker,
+// the staging paths are the users of its mounts.
+type Server struct {
+	driver  *volumeplugin.RancherStorageDriver
+	name    string
+	version string
+	nodeID  string
+	mounter mount.Interface
+}
+
+func NewServer(driver *volumeplugin.RancherStorageDriver, version, nodeID string) *Server {
+	return &Server{
+		driver:  driver,
+		name:    driver.DriverName,
+		version: version,
+		nodeID:  nodeID,
+		mounter: mount.New(),
+	}
+}
+
+// Serve listens on endpoint, for example unix:///var/lib/kubelet/plugins/rancher-nfs/csi.sock
+func (s *Server) Serve(endpoint string) error {
+	if !strings.HasPrefix(endpoint, "unix://") {
+		return fmt.Errorf("Invalid CSI endpoint %s, must be unix://<path>", endpoint)
+	}
+	path := strings.TrimPrefix(endpoint, "unix://")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(logCall))
+	csi.RegisterIdentityServer(server, s)
+	csi.RegisterControllerServer(server, s)
+	csi.RegisterNodeServer(server, s)
+
+	logrus.Infof("Listening for CSI requests on %s", endpoint)
+	return server.Serve(l)
+}
+
+func logCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	logrus.Debugf("csi.request method=%s %+v", info.FullMethod, req)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		logrus.Errorf("csi.response method=%s error=%v", info.FullMethod, err)
+	} else {
+		logrus.Debugf("csi.response method=%s %+v", info.FullMethod, resp)
+	}
+	return resp, err
+}
+
+// responseError converts the error of a driver response to a gRPC status,
+// timeouts are retried by the CO
+func responseError(err string) error {
+	if err == "" {
+		return nil
+	}
+	if volumeplugin.IsNoSuchVolume(err) {
+		return status.Error(codes.NotFound, err)
+	}
+	if volumeplugin.IsNotRemoving(err) {
+		return status.Error(codes.FailedPrecondition, err)
+	}
+	if volumeplugin.IsTimeout(err) {
+		return status.Error(codes.DeadlineExceeded, err)
+	}
+	return status.Error(codes.Internal, err)
+}
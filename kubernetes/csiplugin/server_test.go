@@ -0,0 +1,24 @@
+package csiplugin
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResponseError(t *testing.T) {
+	for err, code := range map[string]codes.Code{
+		"No such volume": codes.NotFound,
+		"The volume is kept in Rancher, it is deleted once Rancher removes it": codes.FailedPrecondition,
+		"Timed out after 10m0s running attach":                                 codes.DeadlineExceeded,
+		"Failed to find 1234.img":                                              codes.Internal,
+	} {
+		if got := status.Code(responseError(err)); got != code {
+			t.Errorf("expected %q to be %v, got %v", err, code, got)
+		}
+	}
+	if responseError("") != nil {
+		t.Error("expected no error for an empty response error")
+	}
+}
@@ -0,0 +1,261 @@
+package flexvolume
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/storage/docker/volumeplugin"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	statusSuccess      = "Success"
+	statusFailure      = "Failure"
+	statusNotSupported = "Not supported"
+
+	k8sFsType     = "kubernetes.io/fsType"
+	k8sVolumeName = "kubernetes.io/pvOrVolumeName"
+	fsType        = "fs-type"
+)
+
+type Capabilities struct {
+	Attach bool `json:"attach"`
+}
+
+// Output is the JSON kubelet expects on stdout of a FlexVolume driver
+type Output struct {
+	Status       string        `json:"status"`
+	Message      string        `json:"message,omitempty"`
+	Device       string        `json:"device,omitempty"`
+	VolumeName   string        `json:"volumeName,omitempty"`
+	Attached     *bool         `json:"attached,omitempty"`
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+}
+
+// Driver translates FlexVolume calls of kubelet to a Backend. Kubelet only
+// calls attach, waitforattach, isattached, mountdevice and their opposites
+// when attach is reported in the capabilities, otherwise mount attaches the
+// volume and unmount detaches it on the node. The scripts can only attach to
+// the host they run on, the volume is then attached by waitforattach and
+// detached by unmountdevice on the node.
+type Driver struct {
+	Backend volumeplugin.Backend
+	Attach  bool
+	// NodeName is the Kubernetes node of this host, the scripts can only
+	// attach volumes to the host they run on
+	NodeName string
+	mounter  mount.Interface
+}
+
+func NewDriver(backend volumeplugin.Backend, attach bool, nodeName string) *Driver {
+	return &Driver{
+		Backend:  backend,
+		Attach:   attach,
+		NodeName: nodeName,
+		mounter:  mount.New(),
+	}
+}
+
+// Run executes the FlexVolume call in args, args[0] being the verb
+func (d *Driver) Run(args []string) Output {
+	if len(args) == 0 {
+		return failure(fmt.Errorf("Missing FlexVolume call"))
+	}
+
+	verb, args := args[0], args[1:]
+	switch {
+	case verb == "init":
+		return d.init()
+	case verb == "getvolumename" && len(args) == 1:
+		return withOptions(args[0], d.getVolumeName)
+	case verb == "attach" && len(args) >= 1:
+		return withOptions(args[0], func(options map[string]string) Output {
+			if len(args) > 1 && !d.isNode(args[1]) {
+				return d.attachElsewhere(args[1])
+			}
+			return d.attach(options)
+		})
+	case verb == "waitforattach" && len(args) == 2:
+		return withOptions(args[1], func(options map[string]string) Output {
+			return d.waitForAttach(args[0], options)
+		})
+	case verb == "isattached" && len(args) >= 1:
+		return withOptions(args[0], d.isAttached)
+	case verb == "detach" && len(args) >= 1:
+		return d.detachVolume(args[0])
+	case verb == "mountdevice" && len(args) == 3:
+		return withOptions(args[2], func(options map[string]string) Output {
+			return d.mountDevice(args[0], args[1], options)
+		})
+	case verb == "unmountdevice" && len(args) == 1:
+		return d.unmountDevice(args[0])
+	case verb == "mount" && len(args) == 2:
+		return withOptions(args[1], func(options map[string]string) Output {
+			return d.mount(args[0], options)
+		})
+	case verb == "unmount" && len(args) == 1:
+		return d.unmountDevice(args[0])
+	}
+	return Output{Status: statusNotSupported}
+}
+
+func (d *Driver) init() Output {
+	if err := d.Backend.Init(); err != nil {
+		return failure(err)
+	}
+	return Output{
+		Status: statusSuccess,
+		Capabilities: &Capabilities{
+			Attach: d.Attach,
+		},
+	}
+}
+
+func (d *Driver) getVolumeName(options map[string]string) Output {
+	return Output{
+		Status:     statusSuccess,
+		VolumeName: volumeName(options),
+	}
+}
+
+func (d *Driver) attach(options map[string]string) Output {
+	device, err := d.doAttach(options)
+	if err != nil {
+		return failure(err)
+	}
+	return Output{
+		Status: statusSuccess,
+		Device: device,
+	}
+}
+
+func (d *Driver) waitForAttach(device string, options map[string]string) Output {
+	if device == "" {
+		return d.attach(options)
+	}
+	if _, err := os.Stat(device); err != nil {
+		return failure(err)
+	}
+	return Output{
+		Status: statusSuccess,
+		Device: device,
+	}
+}
+
+// attachElsewhere answers an attach to another node, made by the controller
+// manager. No device is returned, so waitforattach attaches the volume once
+// kubelet calls it on the node.
+func (d *Driver) attachElsewhere(nodeName string) Output {
+	logrus.Infof("Deferring the attach to node %s until waitforattach runs there", nodeName)
+	return Output{Status: statusSuccess}
+}
+
+func (d *Driver) isNode(nodeName string) bool {
+	return d.NodeName == "" || strings.EqualFold(d.NodeName, nodeName)
+}
+
+// isAttached reports the volumes attach was called for as attached, the
+// drivers have no call to query an attachment and the device only exists on
+// the node between waitforattach and unmountdevice
+func (d *Driver) isAttached(options map[string]string) Output {
+	attached := true
+	return Output{
+		Status:   statusSuccess,
+		Attached: &attached,
+	}
+}
+
+// detachVolume answers detach, which kubelet calls with the name returned by
+// getvolumename rather than a device. The device was detached by
+// unmountdevice on the node already.
+func (d *Driver) detachVolume(name string) Output {
+	logrus.Infof("Volume %s was detached when its device was unmounted", name)
+	return Output{Status: statusSuccess}
+}
+
+func (d *Driver) detach(device string) Output {
+	if err := d.Backend.Detach(device); err != nil && err != volumeplugin.ErrNotSupported {
+		return failure(err)
+	}
+	return Output{Status: statusSuccess}
+}
+
+func (d *Driver) mountDevice(mntDest, device string, options map[string]string) Output {
+	if err := os.MkdirAll(mntDest, 0750); err != nil {
+		return failure(err)
+	}
+	if err := d.Backend.Mount(mntDest, device, volumeName(options), options); err != nil {
+		return failure(err)
+	}
+	return Output{Status: statusSuccess}
+}
+
+// unmountDevice detaches the device of mntDest once nothing else has it
+// mounted
+func (d *Driver) unmountDevice(mntDest string) Output {
+	device, refCount, err := mount.GetDeviceNameFromMount(d.mounter, mntDest)
+	if err != nil {
+		return failure(err)
+	}
+
+	if err := d.Backend.Unmount(mntDest); err == volumeplugin.ErrNotSupported {
+		if err := d.mounter.Unmount(mntDest); err != nil {
+			return failure(err)
+		}
+	} else if err != nil {
+		return failure(err)
+	}
+
+	if device != "" && refCount <= 1 {
+		return d.detach(device)
+	}
+	return Output{Status: statusSuccess}
+}
+
+func (d *Driver) mount(mntDest string, options map[string]string) Output {
+	device, err := d.doAttach(options)
+	if err != nil {
+		return failure(err)
+	}
+	return d.mountDevice(mntDest, device, options)
+}
+
+func (d *Driver) doAttach(options map[string]string) (string, error) {
+	device, err := d.Backend.Attach(volumeName(options), options)
+	if err == volumeplugin.ErrNotSupported {
+		return "", nil
+	}
+	return device, err
+}
+
+// withOptions parses the JSON options passed by kubelet, the filesystem
+// requested by kubelet is passed to the driver as fs-type.
+func withOptions(arg string, call func(map[string]string) Output) Output {
+	options := map[string]string{}
+	if err := json.Unmarshal([]byte(arg), &options); err != nil {
+		return failure(fmt.Errorf("Invalid options %s: %v", arg, err))
+	}
+	if options[fsType] == "" && options[k8sFsType] != "" {
+		options[fsType] = options[k8sFsType]
+	}
+	return call(options)
+}
+
+// volumeName prefers the name option of the driver, RBD for example names
+// the image with it, over the name of the volume in Kubernetes
+func volumeName(options map[string]string) string {
+	if name := options["name"]; name != "" {
+		return name
+	}
+	return options[k8sVolumeName]
+}
+
+func failure(err error) Output {
+	return Output{
+		Status:  statusFailure,
+		Message: err.Error(),
+	}
+}
@@ -0,0 +1,177 @@
+package flexvolume
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/storage/docker/volumeplugin"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// recordingBackend records the calls kubelet is translated to
+type recordingBackend struct {
+	device string
+	calls  []string
+}
+
+func (b *recordingBackend) Init() error {
+	b.calls = append(b.calls, "init")
+	return nil
+}
+
+func (b *recordingBackend) Create(name string, options map[string]string) (map[string]string, error) {
+	return nil, volumeplugin.ErrNotSupported
+}
+
+func (b *recordingBackend) Delete(name string, options map[string]string) error {
+	return volumeplugin.ErrNotSupported
+}
+
+func (b *recordingBackend) Attach(name string, options map[string]string) (string, error) {
+	b.calls = append(b.calls, "attach "+name+" "+options[fsType])
+	return b.device, nil
+}
+
+func (b *recordingBackend) Detach(device string) error {
+	b.calls = append(b.calls, "detach "+device)
+	return nil
+}
+
+func (b *recordingBackend) Mount(mntDest, device, name string, options map[string]string) error {
+	b.calls = append(b.calls, "mount "+filepath.Base(mntDest)+" "+device+" "+name)
+	return nil
+}
+
+func (b *recordingBackend) Unmount(mntDest string) error {
+	b.calls = append(b.calls, "unmount "+filepath.Base(mntDest))
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexvolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	device := filepath.Join(dir, "xvdf")
+	if err := ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	global := filepath.Join(dir, "global")
+	pod := filepath.Join(dir, "pod")
+	options := `{"name":"data","kubernetes.io/fsType":"xfs"}`
+	attached := true
+
+	tests := []struct {
+		name string
+		args []string
+		// mounts are on the host before the call
+		mounts []mount.MountPoint
+		want   Output
+		calls  []string
+	}{
+		{
+			name:  "init",
+			args:  []string{"init"},
+			want:  Output{Status: statusSuccess, Capabilities: &Capabilities{Attach: true}},
+			calls: []string{"init"},
+		},
+		{
+			name: "getvolumename",
+			args: []string{"getvolumename", `{"kubernetes.io/pvOrVolumeName":"pv-1"}`},
+			want: Output{Status: statusSuccess, VolumeName: "pv-1"},
+		},
+		{
+			name:  "attach on the node",
+			args:  []string{"attach", options, "node-1"},
+			want:  Output{Status: statusSuccess, Device: device},
+			calls: []string{"attach data xfs"},
+		},
+		{
+			name: "attach to another node",
+			args: []string{"attach", options, "node-2"},
+			want: Output{Status: statusSuccess},
+		},
+		{
+			name:  "waitforattach of a deferred attach",
+			args:  []string{"waitforattach", "", options},
+			want:  Output{Status: statusSuccess, Device: device},
+			calls: []string{"attach data xfs"},
+		},
+		{
+			name: "waitforattach",
+			args: []string{"waitforattach", device, options},
+			want: Output{Status: statusSuccess, Device: device},
+		},
+		{
+			name: "isattached",
+			args: []string{"isattached", options, "node-2"},
+			want: Output{Status: statusSuccess, Attached: &attached},
+		},
+		{
+			name: "detach",
+			args: []string{"detach", "data", "node-2"},
+			want: Output{Status: statusSuccess},
+		},
+		{
+			name:  "mountdevice",
+			args:  []string{"mountdevice", global, device, options},
+			want:  Output{Status: statusSuccess},
+			calls: []string{"mount global " + device + " data"},
+		},
+		{
+			name:   "unmountdevice",
+			args:   []string{"unmountdevice", global},
+			mounts: []mount.MountPoint{{Device: device, Path: global}},
+			want:   Output{Status: statusSuccess},
+			calls:  []string{"unmount global", "detach " + device},
+		},
+		{
+			name:   "unmountdevice still mounted elsewhere",
+			args:   []string{"unmountdevice", global},
+			mounts: []mount.MountPoint{{Device: device, Path: global}, {Device: device, Path: pod}},
+			want:   Output{Status: statusSuccess},
+			calls:  []string{"unmount global"},
+		},
+		{
+			name:  "mount",
+			args:  []string{"mount", pod, options},
+			want:  Output{Status: statusSuccess},
+			calls: []string{"attach data xfs", "mount pod " + device + " data"},
+		},
+		{
+			name:   "unmount",
+			args:   []string{"unmount", pod},
+			mounts: []mount.MountPoint{{Device: device, Path: pod}},
+			want:   Output{Status: statusSuccess},
+			calls:  []string{"unmount pod", "detach " + device},
+		},
+		{
+			name: "invalid options",
+			args: []string{"mount", pod, "{"},
+			want: Output{Status: statusFailure, Message: "Invalid options {: unexpected end of JSON input"},
+		},
+		{
+			name: "unknown call",
+			args: []string{"expandvolume", options},
+			want: Output{Status: statusNotSupported},
+		},
+	}
+
+	for _, test := range tests {
+		backend := &recordingBackend{device: device}
+		d := NewDriver(backend, true, "node-1")
+		d.mounter = &mount.FakeMounter{MountPoints: test.mounts}
+
+		got := d.Run(test.args)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.want, got)
+		}
+		if !reflect.DeepEqual(backend.calls, test.calls) {
+			t.Errorf("%s: expected the calls %v, got %v", test.name, test.calls, backend.calls)
+		}
+	}
+}
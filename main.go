@@ -1,16 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	dockerClient "github.com/docker/engine-api/client"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/v2"
-	"github.com/rancher/kubernetes-agent/healthcheck"
 	"github.com/rancher/storage/docker/volumeplugin"
+	"github.com/rancher/storage/docker/volumeplugin/drivertest"
+	"github.com/rancher/storage/kubernetes/csiplugin"
+	"github.com/rancher/storage/kubernetes/flexvolume"
 	"github.com/urfave/cli"
 )
 
@@ -29,8 +41,20 @@ func main() {
 	}
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "driver-name",
-			Usage: "The volume driver name",
+			Name:   "driver-name",
+			Usage:  "The volume driver name",
+			EnvVar: "DRIVER_NAME",
+		},
+		cli.StringFlag{
+			Name:   "basedir",
+			Value:  volumeplugin.DefaultBasedir,
+			Usage:  "The directory volumes are mounted and state is kept in",
+			EnvVar: "VOLUMES_BASEDIR",
+		},
+		cli.BoolFlag{
+			Name:   "managed",
+			Usage:  "Run as a Docker managed plugin, volumes are mounted under the propagated mount " + volumeplugin.ManagedBasedir,
+			EnvVar: "MANAGED_PLUGIN",
 		},
 		cli.StringFlag{
 			Name:   "cattle-url",
@@ -47,10 +71,15 @@ func main() {
 			Usage:  "The secret key required to authenticate with cattle server",
 			EnvVar: "CATTLE_SECRET_KEY",
 		},
+		cli.StringFlag{
+			Name:  "metadata-url",
+			Value: volumeplugin.DefaultMetadataURL,
+			Usage: "The Rancher metadata service to find the current host in",
+		},
 		cli.IntFlag{
 			Name:  "healthcheck-interval",
 			Value: 5000,
-			Usage: "set the frequency of performing healthchecks",
+			Usage: "set the frequency in milliseconds of performing healthchecks",
 		},
 		cli.IntFlag{
 			Name:  "healthcheck-port",
@@ -66,39 +95,440 @@ func main() {
 			Name:  "save-on-attach",
 			Usage: "Save volume to Rancher on Volume attach call",
 		},
+		cli.DurationFlag{
+			Name:   "script-timeout",
+			Value:  volumeplugin.DefaultScriptTimeout,
+			Usage:  "Kill calls of the driver script that take longer, 0 to never kill them",
+			EnvVar: "SCRIPT_TIMEOUT",
+		},
+		cli.StringSliceFlag{
+			Name:  "script-timeout-for",
+			Usage: "Override --script-timeout for one call of the driver script, for example --script-timeout-for mount=2m",
+		},
+		cli.IntFlag{
+			Name:   "max-concurrent-ops",
+			Value:  volumeplugin.DefaultMaxConcurrentOps,
+			Usage:  "How many volumes are attached, mounted or unmounted at the same time, operations on the same volume always run one at a time",
+			EnvVar: "MAX_CONCURRENT_OPS",
+		},
+		cli.StringFlag{
+			Name:   "reclaim-policy",
+			Value:  volumeplugin.ReclaimDelete,
+			Usage:  "What happens to the storage of removed volumes without the reclaimPolicy option: retain, delete or archive",
+			EnvVar: "RECLAIM_POLICY",
+		},
+		cli.DurationFlag{
+			Name:   "trash-ttl",
+			Usage:  "Keep the storage of removed volumes in a trash this long before applying the reclaim policy, they can be restored meanwhile. 0 disables the trash",
+			EnvVar: "TRASH_TTL",
+		},
+		cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "Address to serve Prometheus metrics on, for example :9100",
+		},
+		cli.StringFlag{
+			Name:   "state-backend",
+			Value:  "rancher",
+			Usage:  "Where volume state is stored, rancher or local",
+			EnvVar: "STATE_BACKEND",
+		},
+		cli.BoolFlag{
+			Name:   "standalone",
+			Usage:  "Run on a host that is not part of a Rancher environment, volumes are kept in the local state",
+			EnvVar: "STANDALONE",
+		},
+		cli.StringFlag{
+			Name:   "host-id",
+			Usage:  "The identity of this host when standalone, defaults to /etc/machine-id",
+			EnvVar: "HOST_ID",
+		},
+		cli.StringFlag{
+			Name:  "csi-endpoint",
+			Usage: "Serve the CSI services on this socket instead of the Docker volume plugin, for example unix:///var/lib/kubelet/plugins/rancher-nfs/csi.sock",
+		},
+		cli.StringFlag{
+			Name:   "node-id",
+			Usage:  "The CSI node ID or Kubernetes node name of this host, defaults to the hostname",
+			EnvVar: "NODE_ID",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:      "flexvolume",
+			Usage:     "Run a Kubernetes FlexVolume call against the driver, for example storage --driver-name rancher-nfs flexvolume init",
+			ArgsUsage: "<call> [args...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "attach",
+					Usage: "Report the attach capability, volumes are attached by waitforattach on the node when attach runs elsewhere",
+				},
+			},
+			Action: flexVolume,
+		},
+		{
+			Name:      "driver-test",
+			Usage:     "Run a create, attach, mount and delete lifecycle against a driver script and check its output",
+			ArgsUsage: "<script>",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "opt, o",
+					Usage: "Create the test volume with this option, for example --opt size=10",
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "Mount the test volume under this directory instead of a temporary one",
+				},
+			},
+			Action: driverTest,
+		},
+		{
+			Name:      "import",
+			Usage:     "Save storage that was not created by the driver as a volume, for example storage --driver-name rancher-ebs import --opt volumeID=vol-0123 data",
+			ArgsUsage: "<name>",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "opt, o",
+					Usage: "Option of the volume, the driver uses them to find the storage",
+				},
+			},
+			Action: importVolume,
+		},
+		{
+			Name:  "reconcile",
+			Usage: "List the volumes the driver holds and report those missing from the state, missing from the driver or with different options",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "opt, o",
+					Usage: "List the volumes of the driver with this option, for example --opt pool=ssd",
+				},
+				cli.StringFlag{
+					Name:  "orphans",
+					Value: "report",
+					Usage: "What to do with volumes the driver holds that are not in the state: report, import or delete",
+				},
+			},
+			Action: reconcile,
+		},
+		{
+			Name:  "trash",
+			Usage: "Manage the removed volumes kept by a running plugin started with --trash-ttl",
+			Subcommands: []cli.Command{
+				{
+					Name:      "ls",
+					Usage:     "List the removed volumes that can be restored",
+					ArgsUsage: "[name]",
+					Action:    listTrash,
+				},
+				{
+					Name:      "restore",
+					Usage:     "Restore a removed volume, the latest one removed with that name unless --id is set",
+					ArgsUsage: "<name>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "ID of the trash entry to restore, as listed by trash ls",
+						},
+					},
+					Action: restoreTrash,
+				},
+			},
+		},
 	}
 	logrus.Info("Running")
 	app.Run(os.Args)
 }
 
-func start(c *cli.Context) error {
-	logrus.Info("Starting")
-	cli, err := dockerClient.NewClient(c.String("docker-host"), "v1.22", nil, nil)
+func flexVolume(c *cli.Context) error {
+	driverName := c.GlobalString("driver-name")
+	if driverName == "" {
+		return errors.New("--driver-name is required")
+	}
+
+	backend, err := newScriptBackend(c, driverName)
+	if err != nil {
+		return err
+	}
+
+	nodeName := c.GlobalString("node-id")
+	if nodeName == "" {
+		if nodeName, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	d := flexvolume.NewDriver(backend, c.Bool("attach"), nodeName)
+	output := d.Run(c.Args())
+	if err := json.NewEncoder(os.Stdout).Encode(output); err != nil {
+		return err
+	}
+	if output.Status == "Failure" {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func driverTest(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("driver-test requires the driver script as only argument")
+	}
+
+	options, err := parseOpts(c.StringSlice("opt"))
+	if err != nil {
+		return err
+	}
+
+	h := drivertest.NewHarness(c.Args()[0], options)
+	h.Dir = c.String("dir")
+	results, err := h.Run()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", result.Step, result.Err)
+		case result.Skipped != "":
+			fmt.Printf("SKIP  %s: %s\n", result.Step, result.Skipped)
+		default:
+			fmt.Printf("PASS  %s\n", result.Step)
+		}
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d steps failed", failed, len(results)), 1)
+	}
+	return nil
+}
+
+func importVolume(c *cli.Context) error {
+	driverName := c.GlobalString("driver-name")
+	if driverName == "" {
+		return errors.New("--driver-name is required")
+	}
+	if c.NArg() != 1 {
+		return errors.New("import requires the name of the volume as only argument")
+	}
+
+	options, err := parseOpts(c.StringSlice("opt"))
+	if err != nil {
+		return err
+	}
+
+	state, err := newState(c, driverName, basedir(c))
+	if err != nil {
+		return err
+	}
+
+	backend, err := newScriptBackend(c, driverName)
 	if err != nil {
 		return err
 	}
 
-	if _, err := cli.Info(context.Background()); err != nil {
+	name := c.Args()[0]
+	err = volumeplugin.ImportVolume(backend, state, name, options)
+	if err == volumeplugin.ErrNotSupported {
+		return fmt.Errorf("%s does not support import", driverName)
+	} else if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("IMPORTED  %s\n", name)
+	return nil
+}
+
+func reconcile(c *cli.Context) error {
+	driverName := c.GlobalString("driver-name")
+	if driverName == "" {
+		return errors.New("--driver-name is required")
+	}
+
+	orphans := c.String("orphans")
+	switch orphans {
+	case "report", "import", "delete":
+	default:
+		return fmt.Errorf("Invalid --orphans %s, must be report, import or delete", orphans)
+	}
+
+	options, err := parseOpts(c.StringSlice("opt"))
+	if err != nil {
 		return err
 	}
 
-	opts := &client.ClientOpts{
-		Url:       c.String("cattle-url"),
-		AccessKey: c.String("cattle-access-key"),
-		SecretKey: c.String("cattle-secret-key"),
+	state, err := newState(c, driverName, basedir(c))
+	if err != nil {
+		return err
 	}
-	client, err := client.NewRancherClient(opts)
+
+	backend, err := newScriptBackend(c, driverName)
 	if err != nil {
 		return err
 	}
 
+	drifts, err := volumeplugin.Reconcile(backend, state, options)
+	if err == volumeplugin.ErrNotSupported {
+		return fmt.Errorf("%s does not support list", driverName)
+	} else if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if orphans == "delete" {
+		for _, drift := range drifts {
+			if drift.Kind == volumeplugin.DriftOrphan && !drift.Owned {
+				return cli.NewExitError(fmt.Sprintf("%s does not mark the volumes it creates, refusing to delete orphans that may not be its own", driverName), 1)
+			}
+		}
+	}
+
+	unresolved := 0
+	for _, drift := range drifts {
+		switch drift.Kind {
+		case volumeplugin.DriftOrphan:
+			name := drift.Name
+			if name == "" {
+				name = "-"
+			}
+			fmt.Printf("ORPHAN    %s %s\n", name, formatOpts(drift.Options))
+			var err error
+			switch orphans {
+			case "import":
+				if err = volumeplugin.ImportOrphan(backend, state, drift); err == nil {
+					fmt.Printf("IMPORTED  %s\n", name)
+					continue
+				}
+			case "delete":
+				if err = volumeplugin.DeleteOrphan(backend, drift); err == nil {
+					fmt.Printf("DELETED   %s\n", name)
+					continue
+				}
+			}
+			if err != nil {
+				fmt.Printf("FAILED    %s: %v\n", name, err)
+			}
+		case volumeplugin.DriftMissing:
+			fmt.Printf("MISSING   %s %s\n", drift.Name, formatOpts(drift.Options))
+		case volumeplugin.DriftMismatch:
+			for _, key := range drift.Mismatched {
+				fmt.Printf("MISMATCH  %s %s: state %s, driver %s\n", drift.Name, key, drift.Options[key], drift.Backend[key])
+			}
+		}
+		unresolved++
+	}
+
+	if unresolved > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d volumes differ between %s and the state", unresolved, driverName), 1)
+	}
+	return nil
+}
+
+func listTrash(c *cli.Context) error {
+	driverName := c.GlobalString("driver-name")
+	if driverName == "" {
+		return errors.New("--driver-name is required")
+	}
+
+	response := volumeplugin.TrashResponse{}
+	request := volumeplugin.UndeleteRequest{Name: c.Args().First()}
+	if err := callPlugin(c, driverName, "/VolumeDriver.ListTrash", request, &response); err != nil {
+		return err
+	}
+	if response.Err != "" {
+		return cli.NewExitError(response.Err, 1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tREMOVED\tEXPIRES\tPOLICY")
+	for _, e := range response.Trash {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.ID, e.Name, e.Removed.Format(time.RFC3339), e.Expires.Format(time.RFC3339), e.Policy)
+	}
+	return w.Flush()
+}
+
+func restoreTrash(c *cli.Context) error {
+	driverName := c.GlobalString("driver-name")
+	if driverName == "" {
+		return errors.New("--driver-name is required")
+	}
+	if c.NArg() != 1 {
+		return errors.New("trash restore requires the name of the volume as only argument")
+	}
+
+	response := volume.Response{}
+	request := volumeplugin.UndeleteRequest{Name: c.Args()[0], ID: c.String("id")}
+	if err := callPlugin(c, driverName, "/VolumeDriver.Undelete", request, &response); err != nil {
+		return err
+	}
+	if response.Err != "" {
+		return cli.NewExitError(response.Err, 1)
+	}
+	fmt.Printf("RESTORED  %s\n", request.Name)
+	return nil
+}
+
+// callPlugin posts request to the socket of the running plugin and decodes
+// its response, which is also sent with failures
+func callPlugin(c *cli.Context, driverName, path string, request, response interface{}) error {
+	socket := volumeplugin.RancherSocketFile(driverName)
+	if c.GlobalBool("managed") {
+		socket = volumeplugin.ManagedSocketFile(driverName)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post("http://plugin"+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("calling the plugin on %s, is it running: %v", socket, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("decoding the response of %s, status %s: %v", path, resp.Status, err)
+	}
+	return nil
+}
+
+func start(c *cli.Context) error {
+	logrus.Info("Starting")
+	// in CSI mode the CO tracks which volumes are in use, not Docker
+	var cli *dockerClient.Client
+	var err error
+	if c.String("csi-endpoint") == "" {
+		cli, err = dockerClient.NewClient(c.String("docker-host"), "v1.22", nil, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := cli.Info(context.Background()); err != nil {
+			return err
+		}
+	}
+
 	driverName := c.String("driver-name")
 	if driverName == "" {
 		return errors.New("--driver-name is required")
 	}
-	d, err := volumeplugin.NewRancherStorageDriver(driverName, client, cli)
+
+	basedir := basedir(c)
+	state, err := newState(c, driverName, basedir)
+	if err != nil {
+		return err
+	}
+
+	backend, err := newScriptBackend(c, driverName)
+	if err != nil {
+		return err
+	}
+
+	d, err := volumeplugin.NewRancherStorageDriver(driverName, basedir, backend, state, cli)
 	//		DriveName:       driver,
-	//		Basedir:         DefaultBasedir,
 	//		CreateSupported: true,
 	//		Command:         driver,
 	//		client:          client,
@@ -112,16 +542,136 @@ func start(c *cli.Context) error {
 	}
 
 	d.SaveOnAttach = c.Bool("save-on-attach")
+	d.SetMaxConcurrentOps(c.Int("max-concurrent-ops"))
+	if err := d.SetReclaimPolicy(c.String("reclaim-policy")); err != nil {
+		return err
+	}
+	d.SetTrashTTL(c.Duration("trash-ttl"))
 
 	logrus.Infof("Starting plugin for %s", driverName)
-	h := volume.NewHandler(d)
 	if c.Int("healthcheck-port") > 0 {
 		go func() {
-			err := healthcheck.StartHealthCheck(c.Int("healthcheck-port"))
+			interval := time.Duration(c.Int("healthcheck-interval")) * time.Millisecond
+			err := d.StartHealthCheck(c.Int("healthcheck-port"), interval)
 			logrus.Fatalf("Error while running healthcheck [%v]", err)
 		}()
 	}
+	if c.String("metrics-listen") != "" {
+		go func() {
+			err := volumeplugin.ServeMetrics(c.String("metrics-listen"))
+			logrus.Fatalf("Error while serving metrics [%v]", err)
+		}()
+	}
+	if endpoint := c.String("csi-endpoint"); endpoint != "" {
+		nodeID := c.String("node-id")
+		if nodeID == "" {
+			if nodeID, err = os.Hostname(); err != nil {
+				return err
+			}
+		}
+		return csiplugin.NewServer(d, VERSION, nodeID).Serve(endpoint)
+	}
+
+	h := volume.NewHandler(d)
 	volumeplugin.ExtendHandler(h, d)
+	if c.Bool("managed") {
+		return h.ServeUnix("root", volumeplugin.ManagedSocketFile(driverName))
+	}
 	volumeplugin.ForceSymlinkInDockerPlugins(driverName)
 	return h.ServeUnix("root", volumeplugin.RancherSocketFile(driverName))
 }
+
+func newScriptBackend(c *cli.Context, driverName string) (*volumeplugin.ScriptBackend, error) {
+	backend := volumeplugin.NewScriptBackend(driverName)
+	backend.Timeout = c.GlobalDuration("script-timeout")
+	for _, timeout := range c.GlobalStringSlice("script-timeout-for") {
+		parts := strings.SplitN(timeout, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid script timeout %s, must be <call>=<duration>", timeout)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing script timeout %s", timeout)
+		}
+		backend.Timeouts[parts[0]] = duration
+	}
+	return backend, nil
+}
+
+// basedir is where volumes are mounted and the state is kept
+func basedir(c *cli.Context) string {
+	if c.GlobalBool("managed") && !c.GlobalIsSet("basedir") {
+		return volumeplugin.ManagedBasedir
+	}
+	return c.GlobalString("basedir")
+}
+
+func newState(c *cli.Context, driverName, basedir string) (volumeplugin.StateStore, error) {
+	var hostID string
+	backend := c.GlobalString("state-backend")
+	if c.GlobalBool("standalone") {
+		// Cattle only keeps volumes of registered hosts and drivers
+		if c.GlobalIsSet("state-backend") && backend != "local" {
+			return nil, errors.New("--standalone keeps the state locally, --state-backend must be local")
+		}
+		var err error
+		if hostID, err = standaloneHostID(c); err != nil {
+			return nil, err
+		}
+		backend = "local"
+	}
+
+	switch backend {
+	case "rancher":
+		opts := &client.ClientOpts{
+			Url:       c.GlobalString("cattle-url"),
+			AccessKey: c.GlobalString("cattle-access-key"),
+			SecretKey: c.GlobalString("cattle-secret-key"),
+		}
+		client, err := client.NewRancherClient(opts)
+		if err != nil {
+			return nil, err
+		}
+		return volumeplugin.NewRancherState(driverName, c.GlobalString("metadata-url"), client)
+	case "local":
+		return volumeplugin.NewLocalState(driverName, basedir, hostID)
+	}
+	return nil, fmt.Errorf("Invalid --state-backend %s, must be rancher or local", backend)
+}
+
+func standaloneHostID(c *cli.Context) (string, error) {
+	if id := c.GlobalString("host-id"); id != "" {
+		return id, nil
+	}
+	bytes, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		return "", errors.Wrap(err, "--host-id is required when /etc/machine-id can not be read")
+	}
+	id := strings.TrimSpace(string(bytes))
+	if id == "" {
+		return "", errors.New("--host-id is required, /etc/machine-id is empty")
+	}
+	return id, nil
+}
+
+func parseOpts(opts []string) (map[string]string, error) {
+	options := map[string]string{}
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid option %s, must be key=value", opt)
+		}
+		options[parts[0]] = parts[1]
+	}
+	return options, nil
+}
+
+// formatOpts prints options as sorted key=value pairs
+func formatOpts(options map[string]string) string {
+	var pairs []string
+	for k, v := range options {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
@@ -13,6 +13,16 @@ usage() {
     err "\t$0 detach <device>"
     err "\t$0 mount <mount dir> <device> <json params>"
     err "\t$0 unmount <mount dir> <json params>"
+    err "\t$0 snapshot <json params>"
+    err "\t$0 list-snapshots <json params>"
+    err "\t$0 delete-snapshot <json params>"
+    err "\t$0 resize <json params>"
+    err "\t$0 clone <json params> <source json params>"
+    err "\t$0 list [json params]"
+    err "\t$0 import <json params>"
+    err "\t$0 archive <json params>"
+    err "\t$0 trash <json params>"
+    err "\t$0 restore <json params> <trashed json params>"
     err "\t$0 init"
     exit 1
 }
@@ -28,6 +38,19 @@ main()
             parse "$2"
             "$@"
             ;;
+        snapshot|list-snapshots|delete-snapshot|resize|import|archive|trash)
+            parse "$2"
+            optional "$@"
+            ;;
+        list)
+            parse "${2:-"{}"}"
+            optional "$@"
+            ;;
+        clone|restore)
+            parse "$2"
+            parse "$3" SOURCE_OPTS
+            optional "$@"
+            ;;
         detach)
             DEVICE="$2"
             "$@"
@@ -50,12 +73,29 @@ main()
     esac
 }
 
+# Call an optional verb, drivers that do not define it report not supported
+optional()
+{
+    if ! declare -F "$1" >/dev/null; then
+        print_not_supported "$1 is not supported"
+        exit 0
+    fi
+    "$@"
+}
+
+# Set by the plugin config of managed plugins, where volumes live under the
+# propagated mount
+VOLUMES_BASEDIR=${VOLUMES_BASEDIR:-/var/lib/rancher/volumes}
+
 declare -A OPTS
+declare -A SOURCE_OPTS
 parse()
 {
+    # Populates OPTS, or the array named by $2, from the JSON in $1
+    local -n opts=${2:-OPTS}
     mapfile -t < <(echo "$1" | jq -r 'to_entries | map([.key, .value]) | .[]' | jq '.[]' | sed 's!^"\(.*\)"$!\1!g')
     for ((i=0;i < ${#MAPFILE[@]} ; i+=2)) do
-        OPTS[${MAPFILE[$i]}]=${MAPFILE[$((i+1))]}
+        opts[${MAPFILE[$i]}]=${MAPFILE[$((i+1))]}
     done
 }
 
@@ -72,6 +112,26 @@ print_device()
     echo -n "$@" | jq -R -c -s '{"status": "Success", "device": .}'
 }
 
+print_snapshot()
+{
+    jq -n -c --arg i "$1" --arg n "$2" --arg c "$3" '{"status": "Success", "snapshot": {"id": $i, "name": $n, "created": $c}}'
+}
+
+print_snapshots()
+{
+    # $1 is a JSON array of {"id": ..., "name": ..., "created": ...} objects
+    echo -n "$1" | jq -c '{"status": "Success", "snapshots": .}'
+}
+
+print_volumes()
+{
+    # $1 is a JSON array of {"name": ..., "options": {...}} objects, name is
+    # empty for volumes the backend does not know the name of. Volumes the
+    # backend has marked as its own have "owned": true, only they can be
+    # deleted as orphans
+    echo -n "$1" | jq -c '{"status": "Success", "volumes": .}'
+}
+
 print_not_supported()
 {
     echo -n "$@" | jq -R -c -s '{"status": "Not supported", "message": .}'
@@ -121,6 +181,78 @@ ismounted() {
     fi
 }
 
+# Format a device with the filesystem named by the fs-type option, ext4 when
+# it is not set. Extra arguments to mkfs, for example an inode ratio or a
+# label, are taken from the mkfs-options option.
+format_device() {
+    local device=$1
+    local fsType=${OPTS[fs-type]:-ext4}
+    local force
+
+    case "${fsType}" in
+        ext2|ext3|ext4)
+            force="-F"
+            ;;
+        xfs|btrfs)
+            force="-f"
+            ;;
+        *)
+            echo "Formatting ${device} with ${fsType} is not supported"
+            return 1
+            ;;
+    esac
+
+    mkfs.${fsType} ${force} ${OPTS[mkfs-options]} ${device} 2>&1
+}
+
+# Check that the filesystem on a device is the one named by the fs-type
+# option. Devices that are not formatted yet pass the check.
+check_fs_type() {
+    local device=$1
+    local fsType=${OPTS[fs-type]}
+    local actual=$(blkid -o value -s TYPE ${device})
+
+    if [ -n "${fsType}" ] && [ -n "${actual}" ] && [ "${fsType}" != "${actual}" ]; then
+        echo "${device} is formatted with ${actual} but ${fsType} was requested"
+        return 1
+    fi
+}
+
+# Grow the filesystem on a device to the size of the device. Filesystems that
+# can only be grown online need the mount point as second argument.
+grow_fs() {
+    local device=$1
+    local mountPoint=$2
+    local fsType=$(blkid -o value -s TYPE ${device})
+
+    case "${fsType}" in
+        ext2|ext3|ext4)
+            resize2fs ${device} 2>&1
+            ;;
+        xfs)
+            if [ -z "${mountPoint}" ]; then
+                echo "xfs filesystem on ${device} must be mounted to grow"
+                return 1
+            fi
+            xfs_growfs ${mountPoint} 2>&1
+            ;;
+        btrfs)
+            if [ -z "${mountPoint}" ]; then
+                echo "btrfs filesystem on ${device} must be mounted to grow"
+                return 1
+            fi
+            btrfs filesystem resize max ${mountPoint} 2>&1
+            ;;
+        "")
+            # not formatted yet, nothing to grow
+            ;;
+        *)
+            echo "Growing ${fsType} filesystem on ${device} is not supported"
+            return 1
+            ;;
+    esac
+}
+
 unset_aws_credentials_env() {
     if [ -z "${AWS_ACCESS_KEY_ID}" ] || [ -z "${AWS_SECRET_ACCESS_KEY}" ]; then
         unset AWS_ACCESS_KEY_ID
@@ -1,5 +1,8 @@
 #!/bin/bash
 
 update-rancher-ssl
-mount --rbind /host/dev /dev
+# managed plugins get /dev from their config.json
+if [ -d /host/dev ]; then
+    mount --rbind /host/dev /dev
+fi
 exec "$@"
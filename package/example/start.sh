@@ -1,4 +1,7 @@
 #!/bin/bash
 
-mount --rbind /host/dev /dev
+# managed plugins get /dev from their config.json
+if [ -d /host/dev ]; then
+    mount --rbind /host/dev /dev
+fi
 exec "$@"